@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const githubBodyLimit = 65000
+
+func sendGitHub(config Config, data QueryResult, showQuery bool, debug bool) error {
+	github := config.GitHub
+	baseURL := strings.TrimRight(strings.TrimSpace(github.APIURL), "/")
+	if baseURL == "" {
+		baseURL = "https://api.github.com"
+	}
+	body := githubBody(config, data, showQuery)
+	repo := strings.TrimSpace(github.Repo)
+
+	if github.Issue > 0 {
+		debugf(debug, "github: commenting on %s#%d", repo, github.Issue)
+		endpoint := fmt.Sprintf("%s/repos/%s/issues/%d/comments", baseURL, repo, github.Issue)
+		return githubPost(endpoint, github.Token, map[string]interface{}{"body": body})
+	}
+
+	title := github.Title
+	if strings.TrimSpace(title) == "" {
+		title = config.SMTP.Subject
+	}
+	if strings.TrimSpace(title) == "" {
+		title = "notifysql report"
+	}
+	payload := map[string]interface{}{"title": title, "body": body}
+	if len(github.Labels) > 0 {
+		payload["labels"] = github.Labels
+	}
+	debugf(debug, "github: opening issue in %s", repo)
+	return githubPost(baseURL+"/repos/"+repo+"/issues", github.Token, payload)
+}
+
+func githubBody(config Config, data QueryResult, showQuery bool) string {
+	data = fillNulls(config, "markdown", data)
+	var builder strings.Builder
+	if showQuery {
+		builder.WriteString("**SQL Query:**\n\n```sql\n" + config.SQL + "\n```\n\n")
+	}
+	builder.WriteString(fmt.Sprintf("**Result (%d rows):**\n\n", data.rowCount()))
+	if len(data.Rows) == 0 {
+		builder.WriteString("No rows returned.")
+	} else {
+		builder.WriteString(renderMarkdown(data.Columns, data.Rows, columnAligns(config, data.Columns)))
+	}
+	body := builder.String()
+	if len(body) > githubBodyLimit {
+		cut := strings.LastIndex(body[:githubBodyLimit], "\n")
+		if cut < 0 {
+			cut = githubBodyLimit
+		}
+		body = body[:cut] + "\n\n_Result truncated to fit the GitHub comment size limit._"
+	}
+	return body
+}
+
+func githubPost(endpoint string, token string, payload interface{}) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("json encode failed: %w", err)
+	}
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("github request failed: %w", err)
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("github post failed: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	if response.StatusCode == http.StatusTooManyRequests ||
+		(response.StatusCode == http.StatusForbidden && response.Header.Get("X-RateLimit-Remaining") == "0") {
+		if retry := response.Header.Get("Retry-After"); retry != "" {
+			return fmt.Errorf("github rate limit exceeded, retry after %ss", retry)
+		}
+		if reset, err := strconv.ParseInt(response.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return fmt.Errorf("github rate limit exceeded, resets at %s", time.Unix(reset, 0).UTC().Format(time.RFC3339))
+		}
+		return fmt.Errorf("github rate limit exceeded: %s", strings.TrimSpace(string(detail)))
+	}
+	return fmt.Errorf("github post failed: %s %s", response.Status, strings.TrimSpace(string(detail)))
+}
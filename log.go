@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// stderrLog is the single writer for diagnostics: debug lines, warnings,
+// errors and the -log-json run event. Jobs run concurrently, so writes are
+// serialized to keep lines whole.
+type stderrLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+var logger = &stderrLog{out: os.Stderr}
+
+func (l *stderrLog) printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = fmt.Fprintf(l.out, format+"\n", args...)
+}
+
+func (l *stderrLog) println(args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = fmt.Fprintln(l.out, args...)
+}
+
+// errorf writes an error line, marked like the "warning:" lines so it stands
+// out from debug output.
+func (l *stderrLog) errorf(format string, args ...interface{}) {
+	l.printf("error: "+format, args...)
+}
+
+// runEvent is the one-line JSON summary written per run with -log-json.
+type runEvent struct {
+	Time       string `json:"time"`
+	Job        string `json:"job,omitempty"`
+	DBType     string `json:"db_type"`
+	Output     string `json:"output"`
+	Rows       int    `json:"rows"`
+	DurationMS int64  `json:"duration_ms"`
+	Sent       bool   `json:"sent"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newRunEvent(config Config, options runOptions, start time.Time, err error) runEvent {
+	event := runEvent{
+		Time:       start.UTC().Format(time.RFC3339),
+		Job:        options.Job,
+		DBType:     config.DB.Type,
+		Output:     options.Stats.Output,
+		Rows:       options.Stats.Rows,
+		DurationMS: time.Since(start).Milliseconds(),
+		Sent:       options.Stats.Sent,
+		Status:     "ok",
+	}
+	if event.Output == "" {
+		event.Output = config.Output
+	}
+	if err != nil {
+		event.Status = "failed"
+		event.Error = err.Error()
+	}
+	return event
+}
+
+func (l *stderrLog) event(event runEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		l.println(err)
+		return
+	}
+	l.println(string(line))
+}
@@ -2,59 +2,290 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"html"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"math/big"
+	"mime"
+	"mime/quotedprintable"
 	"net"
+	"net/mail"
 	"net/smtp"
 	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 	_ "github.com/ClickHouse/clickhouse-go/v2"
 	_ "github.com/denisenkom/go-mssqldb"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/robfig/cron/v3"
+	_ "modernc.org/sqlite"
 )
 
 type Config struct {
-	SQL       string     `toml:"sql"`
-	Output    string     `toml:"output"`
-	ShowQuery *bool      `toml:"show_query"`
-	DB        DBConfig   `toml:"db"`
-	SMTP      SMTPConfig `toml:"smtp"`
+	SQL                      string            `toml:"sql"`
+	SQLFile                  string            `toml:"sql_file"`
+	Statements               []string          `toml:"statements"`
+	Output                   string            `toml:"output"`
+	OutputFile               string            `toml:"output_file"`
+	BodyTemplateFile         string            `toml:"body_template_file"`
+	ShowQuery                *bool             `toml:"show_query"`
+	ShowTiming               bool              `toml:"show_timing"`
+	CSVNullAsEmpty           bool              `toml:"csv_null_as_empty"`
+	NullString               string            `toml:"null_string"`
+	CSVDelimiter             string            `toml:"csv_delimiter"`
+	CSVCRLF                  bool              `toml:"csv_crlf"`
+	CSVBOM                   bool              `toml:"csv_bom"`
+	JSONSchema               bool              `toml:"json_schema"`
+	OutputEncoding           string            `toml:"output_encoding"`
+	OutputEncodingStrict     bool              `toml:"output_encoding_strict"`
+	TableResponsive          bool              `toml:"table_responsive"`
+	TextEscape               bool              `toml:"text_escape"`
+	MaxCellWidth             int               `toml:"max_cell_width"`
+	StatusColumn             string            `toml:"status_column"`
+	StatusColors             map[string]string `toml:"status_colors"`
+	StatusColumnHidden       bool              `toml:"status_column_hidden"`
+	Environment              string            `toml:"environment"`
+	FetchAllPages            bool              `toml:"fetch_all_pages"`
+	PageTokenColumn          string            `toml:"page_token_column"`
+	InlineMaxRows            int               `toml:"inline_max_rows"`
+	MaxRowsFetched           int               `toml:"max_rows_fetched"`
+	InlineColumns            []string          `toml:"inline_columns"`
+	SplitAttachmentBy        string            `toml:"split_attachment_by"`
+	ExtraAttachments         []string          `toml:"extra_attachments"`
+	AllResultSets            bool              `toml:"all_result_sets"`
+	AttachmentName           string            `toml:"attachment_name"`
+	AttachmentChecksum       bool              `toml:"attachment_checksum"`
+	AttachmentChecksumHeader bool              `toml:"attachment_checksum_header"`
+	CountQuery               string            `toml:"count_query"`
+	CountMessage             string            `toml:"count_message"`
+	DatetimeFormat           string            `toml:"datetime_format"`
+	NumberFormat             NumberFormat      `toml:"number_format"`
+	HumanizeColumns          map[string]string `toml:"humanize_columns"`
+	ColumnRules              []ColumnRule      `toml:"column"`
+	Highlights               []HighlightRule   `toml:"highlight"`
+	JobConcurrency           int               `toml:"job_concurrency"`
+	Schedule                 string            `toml:"schedule"`
+	StateFile                string            `toml:"state_file"`
+	SuppressDuplicates       bool              `toml:"suppress_duplicates"`
+	ResendAfter              string            `toml:"resend_after"`
+	WatermarkColumn          string            `toml:"watermark_column"`
+	WatermarkSeed            string            `toml:"watermark_seed"`
+	From                     string            `toml:"from"`
+	To                       string            `toml:"to"`
+	Params                   []interface{}     `toml:"params"`
+	Sources                  []SourceConfig    `toml:"source"`
+	SourceLabelColumn        string            `toml:"source_label_column"`
+	Jobs                     []JobConfig       `toml:"job"`
+	Notify                   []string          `toml:"notify"`
+	NotifyOn                 string            `toml:"notify_on"`
+	MinRows                  int               `toml:"min_rows"`
+	MaxRows                  int               `toml:"max_rows"`
+	DB                       DBConfig          `toml:"db"`
+	SMTP                     SMTPConfig        `toml:"smtp"`
+	NATS                     NATSConfig        `toml:"nats"`
+	Webhook                  WebhookConfig     `toml:"webhook"`
+	Opsgenie                 OpsgenieConfig    `toml:"opsgenie"`
+	GitHub                   GitHubConfig      `toml:"github"`
+	Slack                    SlackConfig       `toml:"slack"`
+	OnFailure                FailureConfig     `toml:"on_failure"`
 }
 
 type DBConfig struct {
-	Type    string `toml:"type"`
-	Host    string `toml:"host"`
-	Port    int    `toml:"port"`
-	User    string `toml:"user"`
-	Pass    string `toml:"pass"`
-	Name    string `toml:"name"`
-	SSLMode string `toml:"ssl_mode"`
-	DSN     string `toml:"dsn"`
+	Type            string            `toml:"type"`
+	Provider        string            `toml:"provider"`
+	Host            string            `toml:"host"`
+	Port            int               `toml:"port"`
+	User            string            `toml:"user"`
+	Pass            string            `toml:"pass"`
+	PassFile        string            `toml:"pass_file"`
+	Name            string            `toml:"name"`
+	SSLMode         string            `toml:"ssl_mode"`
+	TLSCAFile       string            `toml:"tls_ca_file"`
+	Options         map[string]string `toml:"options"`
+	SimpleProtocol  bool              `toml:"simple_protocol"`
+	Timeout         int               `toml:"timeout"`
+	Retries         int               `toml:"retries"`
+	RetryDelay      int               `toml:"retry_delay"`
+	MaxOpenConns    int               `toml:"max_open_conns"`
+	MaxIdleConns    int               `toml:"max_idle_conns"`
+	ConnMaxLifetime int               `toml:"conn_max_lifetime"`
+	DSN             string            `toml:"dsn"`
+	DSNTemplate     string            `toml:"dsn_template"`
+	CollectWarnings bool              `toml:"collect_warnings"`
+	Setup           []string          `toml:"-"`
+	AllResultSets   bool              `toml:"-"`
+	Debug           bool              `toml:"-"`
+}
+
+type NotifyRule struct {
+	NotifyOnEmpty *bool `toml:"notify_on_empty"`
+	NotifyMinRows int   `toml:"notify_min_rows"`
+}
+
+func (rule NotifyRule) allows(rowCount int) bool {
+	if rowCount == 0 && rule.NotifyOnEmpty != nil && !*rule.NotifyOnEmpty {
+		return false
+	}
+	return rowCount >= rule.NotifyMinRows
+}
+
+type SourceConfig struct {
+	Label string `toml:"label"`
+	DBConfig
 }
 
 type SMTPConfig struct {
-	Host    string   `toml:"host"`
-	Port    int      `toml:"port"`
-	User    string   `toml:"user"`
-	Pass    string   `toml:"pass"`
-	From    string   `toml:"from"`
+	Host                  string            `toml:"host"`
+	Port                  int               `toml:"port"`
+	User                  string            `toml:"user"`
+	Pass                  string            `toml:"pass"`
+	PassFile              string            `toml:"pass_file"`
+	AuthType              string            `toml:"auth_type"`
+	OAuthToken            string            `toml:"oauth_token"`
+	OAuthTokenFile        string            `toml:"oauth_token_file"`
+	From                  string            `toml:"from"`
+	To                    []string          `toml:"to"`
+	Cc                    []string          `toml:"cc"`
+	Bcc                   []string          `toml:"bcc"`
+	RecipientsQuery       string            `toml:"recipients_query"`
+	Subject               string            `toml:"subject"`
+	SubjectEmpty          string            `toml:"subject_empty"`
+	ReplyTo               string            `toml:"reply_to"`
+	Headers               map[string]string `toml:"headers"`
+	TLS                   bool              `toml:"tls"`
+	TLSPin                string            `toml:"tls_pin"`
+	TLSCAFile             string            `toml:"tls_ca_file"`
+	TLSInsecureSkipVerify bool              `toml:"tls_insecure_skip_verify"`
+	ReuseConnection       bool              `toml:"reuse_connection"`
+	Retries               int               `toml:"retries"`
+	RetryDelay            int               `toml:"retry_delay"`
+	Timeout               int               `toml:"timeout"`
+	Helo                  string            `toml:"helo"`
+	Backend               string            `toml:"backend"`
+	Environment           string            `toml:"-"`
+	ExtraHeaders          map[string]string `toml:"-"`
+	TextAlternative       string            `toml:"-"`
+	DryRun                bool              `toml:"-"`
+	NotifyRule
+}
+
+type NATSConfig struct {
+	URL       string `toml:"url"`
+	Subject   string `toml:"subject"`
+	User      string `toml:"user"`
+	Pass      string `toml:"pass"`
+	Token     string `toml:"token"`
+	CredsFile string `toml:"creds_file"`
+	PerRow    bool   `toml:"per_row"`
+	NotifyRule
+}
+
+type WebhookConfig struct {
+	URL             string            `toml:"url"`
+	Method          string            `toml:"method"`
+	Headers         map[string]string `toml:"headers"`
+	Secret          string            `toml:"secret"`
+	SignatureHeader string            `toml:"signature_header"`
+	NotifyRule
+}
+
+type OpsgenieConfig struct {
+	APIKey       string   `toml:"api_key"`
+	APIURL       string   `toml:"api_url"`
+	Alias        string   `toml:"alias"`
+	Message      string   `toml:"message"`
+	Priority     string   `toml:"priority"`
+	Tags         []string `toml:"tags"`
+	CloseOnClear bool     `toml:"close_on_clear"`
+	NotifyRule
+}
+
+type GitHubConfig struct {
+	Token  string   `toml:"token"`
+	Repo   string   `toml:"repo"`
+	Issue  int      `toml:"issue"`
+	Title  string   `toml:"title"`
+	Labels []string `toml:"labels"`
+	APIURL string   `toml:"api_url"`
+	NotifyRule
+}
+
+type SlackConfig struct {
+	WebhookURL string `toml:"webhook_url"`
+	Channel    string `toml:"channel"`
+	NotifyRule
+}
+
+type JobConfig struct {
+	Name    string   `toml:"name"`
+	SQL     string   `toml:"sql"`
+	Output  string   `toml:"output"`
 	To      []string `toml:"to"`
 	Cc      []string `toml:"cc"`
 	Bcc     []string `toml:"bcc"`
 	Subject string   `toml:"subject"`
-	TLS     bool     `toml:"tls"`
+}
+
+type FailureConfig struct {
+	To         []string `toml:"to"`
+	Cc         []string `toml:"cc"`
+	Bcc        []string `toml:"bcc"`
+	Subject    string   `toml:"subject"`
+	WebhookURL string   `toml:"webhook_url"`
+}
+
+type runOptions struct {
+	MailTest   bool
+	DBTest     bool
+	ShowQuery  bool
+	Debug      bool
+	RenderFrom string
+	MetricLine bool
+	DryRun     bool
+	CountOnly  bool
+	LogJSON    bool
+	Preview    int
+	Job        string
+	Stats      *runStats
+}
+
+// runStats is filled in by run for the -metric-line summary.
+type runStats struct {
+	Rows   int
+	Sent   bool
+	Output string
 }
 
 type optionalBool struct {
@@ -101,22 +332,94 @@ func (o *optionalInt) Set(value string) error {
 	return nil
 }
 
+// Set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+func versionString() string {
+	revision, built := commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && revision == "":
+				revision = setting.Value
+			case setting.Key == "vcs.time" && built == "":
+				built = setting.Value
+			}
+		}
+	}
+	if revision == "" {
+		revision = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return fmt.Sprintf("notifysql %s (commit %s, built %s, %s)", version, revision, built, runtime.Version())
+}
+
+type paramList []string
+
+func (p *paramList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *paramList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
 func main() {
 	configPath := flag.String("config", "config.toml", "Config file path")
-	sqlFlag := flag.String("sql", "", "SQL query to run")
-	outputFlag := flag.String("output", "", "Output format: csv, text, or table")
+	versionFlag := flag.Bool("version", false, "Print version and build info, then exit")
+	jobFlag := flag.String("job", "", "Run only the named [[job]]")
+	sqlFlag := flag.String("sql", "", "SQL query to run, or - to read it from stdin")
+	sqlFileFlag := flag.String("sql-file", "", "Read the SQL query from this file")
+	toFileFlag := flag.String("to-file", "", "Write the rendered result to this file; mail is only sent if smtp.host is set")
+	outputFlag := flag.String("output", "", "Output format: csv, text, table-text, table, html, json, markdown, xlsx, or pdf")
+	scheduleFlag := flag.String("schedule", "", "Keep running and repeat the run on this cron schedule, e.g. \"*/5 * * * *\"")
+	outputEncodingFlag := flag.String("output-encoding", "", "Character set for text attachments, e.g. windows-1252 or iso-8859-1 (default utf-8)")
 	mailTest := flag.Bool("test-mail", false, "Send test email only")
 	dbTest := flag.Bool("test-db", false, "Test database connection only")
 	debug := flag.Bool("debug", false, "Enable debug output")
+	logJSON := flag.Bool("log-json", false, "Write a one-line JSON summary of each run to stderr")
+	validateOnly := flag.Bool("validate", false, "Check the config, templates and DSNs, print \"config OK\" and exit without connecting")
+	countOnly := flag.Bool("count-only", false, "Send only the row count instead of the result")
+	dryRun := flag.Bool("dry-run", false, "Run the query and print the email that would be sent instead of sending it")
+	metricLineFlag := flag.Bool("metric-line", false, "Print a single-line run summary (rows, duration, sent) to stdout on completion")
+	notifyFlag := flag.String("notify", "", "Comma-separated delivery backends: email, nats, webhook, opsgenie, github, slack")
+	notifyOnFlag := flag.String("notify-on", "", "When to deliver: always, rows, or empty")
+	envFlag := flag.String("env", "", "Environment tag added to the subject and X-NotifySQL-Env header")
+	fromFlag := flag.String("from", "", "Start of the reporting window, bound as :from")
+	toFlag := flag.String("to", "", "End of the reporting window, bound as :to")
+	preview := flag.Int("n", 0, "Preview: deliver only the first N rows of the result, noting the full row count (0 = all rows)")
+	flag.IntVar(preview, "preview", 0, "Same as -n")
+	renderFrom := flag.String("render-from", "", "Render columns/rows from a local CSV or JSON file instead of querying the database")
 	var showQueryFlag optionalBool
 
 	var dbPort optionalInt
+	var dbTimeout optionalInt
+	var minRows optionalInt
+	var maxRows optionalInt
 	var smtpPort optionalInt
+	var smtpRetries optionalInt
+	var smtpRetryDelay optionalInt
+	var smtpTimeout optionalInt
 	var smtpTLS optionalBool
+	var paramFlags paramList
+	var maxRowsFetched optionalInt
 
-	flag.String("db-type", "", "Database type: mysql or postgres")
+	flag.Var(&minRows, "min-rows", "Deliver only when at least this many rows are returned (0 = no minimum)")
+	flag.Var(&maxRows, "max-rows", "Deliver only when at most this many rows are returned (0 = no maximum)")
+	flag.Var(&maxRowsFetched, "max-rows-fetched", "Stop reading the result after this many rows (0 = no limit)")
+	flag.Var(&paramFlags, "param", "Positional query parameter (repeatable, in placeholder order)")
+
+	flag.String("db-type", "", "Database type: mysql, postgres, mssql, clickhouse, or sqlite")
 	flag.String("db-host", "", "Database host")
 	flag.Var(&dbPort, "db-port", "Database port")
+	flag.Var(&dbTimeout, "db-timeout", "Query timeout in seconds (0 = no timeout)")
 	flag.String("db-user", "", "Database user")
 	flag.String("db-pass", "", "Database password")
 	flag.String("db-name", "", "Database name")
@@ -132,23 +435,92 @@ func main() {
 	flag.String("smtp-cc", "", "Comma-separated cc addresses")
 	flag.String("smtp-bcc", "", "Comma-separated bcc addresses")
 	flag.String("smtp-subject", "", "Mail subject")
+	flag.String("smtp-subject-empty", "", "Mail subject used when the query returns no rows")
 	flag.Var(&smtpTLS, "smtp-tls", "Use STARTTLS (true/false)")
+	flag.Var(&smtpRetries, "smtp-retries", "Retry transient SMTP failures this many times")
+	flag.Var(&smtpRetryDelay, "smtp-retry-delay", "Seconds before the first SMTP retry, doubled each attempt (default 5)")
+	flag.String("smtp-helo", "", "Hostname sent in SMTP EHLO/HELO (default: localhost, or the system hostname with -debug)")
+	flag.Var(&smtpTimeout, "smtp-timeout", "SMTP connect and read/write timeout in seconds (0 = no timeout)")
 	flag.Var(&showQueryFlag, "show-query", "Include SQL query in email (true/false)")
 
+	flag.String("nats-url", "", "NATS server URL")
+	flag.String("nats-subject", "", "NATS subject to publish to")
+	flag.String("nats-user", "", "NATS user")
+	flag.String("nats-pass", "", "NATS password")
+	flag.String("nats-token", "", "NATS token")
+	flag.String("nats-creds", "", "NATS credentials file")
+
 	flag.Parse()
 
+	if *versionFlag {
+		fmt.Println(versionString())
+		return
+	}
+
+	// setupFailed ends a run that fails before it starts, in loading or
+	// validating the config, with the same metric line and -log-json event
+	// a failed run gets.
+	start := time.Now()
+	var config Config
+	setupFailed := func(err error) {
+		options := runOptions{Stats: &runStats{Rows: -1}}
+		if *metricLineFlag {
+			fmt.Println(metricLine(options, time.Since(start), err))
+		}
+		if *logJSON {
+			logger.event(newRunEvent(config, options, start, err))
+		}
+		fatal(err)
+	}
 	config, err := loadConfig(*configPath, flagPassed("config"))
 	if err != nil {
-		fatal(err)
+		setupFailed(err)
 	}
 
+	if *sqlFlag == "-" {
+		if *sqlFlag, err = readSQLStdin(os.Stdin); err != nil {
+			setupFailed(err)
+		}
+	}
+	config.SQLFile = overrideString(config.SQLFile, *sqlFileFlag)
+	if strings.TrimSpace(*sqlFlag) == "" && strings.TrimSpace(config.SQLFile) != "" {
+		if config.SQL, err = readSQLFile(config.SQLFile); err != nil {
+			setupFailed(err)
+		}
+	}
 	config.SQL = overrideString(config.SQL, *sqlFlag)
 	config.Output = overrideString(config.Output, *outputFlag)
+	config.OutputEncoding = overrideString(config.OutputEncoding, *outputEncodingFlag)
+	config.OutputFile = overrideString(config.OutputFile, *toFileFlag)
+	config.Schedule = overrideString(config.Schedule, *scheduleFlag)
+	config.Notify = overrideList(config.Notify, *notifyFlag)
+	config.NotifyOn = overrideString(config.NotifyOn, *notifyOnFlag)
+	if minRows.set {
+		config.MinRows = minRows.value
+	}
+	if maxRowsFetched.set {
+		config.MaxRowsFetched = maxRowsFetched.value
+	}
+	if maxRows.set {
+		config.MaxRows = maxRows.value
+	}
+	config.Environment = overrideString(config.Environment, *envFlag)
+	config.From = overrideString(config.From, *fromFlag)
+	config.To = overrideString(config.To, *toFlag)
+	if len(paramFlags) > 0 {
+		config.Params = make([]interface{}, len(paramFlags))
+		for i, value := range paramFlags {
+			config.Params[i] = parseParamValue(value)
+		}
+	}
 	config.DB.Type = overrideString(config.DB.Type, flag.Lookup("db-type").Value.String())
 	config.DB.Host = overrideString(config.DB.Host, flag.Lookup("db-host").Value.String())
 	if dbPort.set {
 		config.DB.Port = dbPort.value
 	}
+	if dbTimeout.set {
+		config.DB.Timeout = dbTimeout.value
+	}
 	config.DB.User = overrideString(config.DB.User, flag.Lookup("db-user").Value.String())
 	config.DB.Pass = overrideString(config.DB.Pass, flag.Lookup("db-pass").Value.String())
 	config.DB.Name = overrideString(config.DB.Name, flag.Lookup("db-name").Value.String())
@@ -163,12 +535,31 @@ func main() {
 	config.SMTP.Pass = overrideString(config.SMTP.Pass, flag.Lookup("smtp-pass").Value.String())
 	config.SMTP.From = overrideString(config.SMTP.From, flag.Lookup("smtp-from").Value.String())
 	config.SMTP.Subject = overrideString(config.SMTP.Subject, flag.Lookup("smtp-subject").Value.String())
+	config.SMTP.SubjectEmpty = overrideString(config.SMTP.SubjectEmpty, flag.Lookup("smtp-subject-empty").Value.String())
 	config.SMTP.To = overrideList(config.SMTP.To, flag.Lookup("smtp-to").Value.String())
 	config.SMTP.Cc = overrideList(config.SMTP.Cc, flag.Lookup("smtp-cc").Value.String())
 	config.SMTP.Bcc = overrideList(config.SMTP.Bcc, flag.Lookup("smtp-bcc").Value.String())
 	if smtpTLS.set {
 		config.SMTP.TLS = smtpTLS.value
 	}
+	if smtpRetries.set {
+		config.SMTP.Retries = smtpRetries.value
+	}
+	if smtpRetryDelay.set {
+		config.SMTP.RetryDelay = smtpRetryDelay.value
+	}
+	if smtpTimeout.set {
+		config.SMTP.Timeout = smtpTimeout.value
+	}
+	config.SMTP.Helo = overrideString(config.SMTP.Helo, flag.Lookup("smtp-helo").Value.String())
+	config.SMTP.Environment = strings.TrimSpace(config.Environment)
+
+	config.NATS.URL = overrideString(config.NATS.URL, flag.Lookup("nats-url").Value.String())
+	config.NATS.Subject = overrideString(config.NATS.Subject, flag.Lookup("nats-subject").Value.String())
+	config.NATS.User = overrideString(config.NATS.User, flag.Lookup("nats-user").Value.String())
+	config.NATS.Pass = overrideString(config.NATS.Pass, flag.Lookup("nats-pass").Value.String())
+	config.NATS.Token = overrideString(config.NATS.Token, flag.Lookup("nats-token").Value.String())
+	config.NATS.CredsFile = overrideString(config.NATS.CredsFile, flag.Lookup("nats-creds").Value.String())
 
 	showQuery := true
 	if config.ShowQuery != nil {
@@ -177,9 +568,51 @@ func main() {
 	if showQueryFlag.set {
 		showQuery = showQueryFlag.value
 	}
+	config.ShowQuery = &showQuery
+	options := runOptions{
+		MailTest:   *mailTest,
+		DBTest:     *dbTest,
+		ShowQuery:  showQuery,
+		Debug:      *debug,
+		RenderFrom: *renderFrom,
+		MetricLine: *metricLineFlag,
+		DryRun:     *dryRun,
+		CountOnly:  *countOnly,
+		LogJSON:    *logJSON,
+		Preview:    *preview,
+	}
+	config.SMTP.DryRun = *dryRun
+	config.DB.Debug = *debug
 
-	if err := validateConfig(config, *mailTest, *dbTest); err != nil {
-		fatal(err)
+	if name := strings.TrimSpace(*jobFlag); name != "" {
+		if config.Jobs, err = selectJob(config.Jobs, name); err != nil {
+			setupFailed(err)
+		}
+	}
+	if err := validateConfig(config, options); err != nil {
+		setupFailed(err)
+	}
+	if *validateOnly {
+		if options.RenderFrom == "" {
+			if err := validateDSNs(config); err != nil {
+				setupFailed(err)
+			}
+		}
+		fmt.Println("config OK")
+		return
+	}
+	if strings.TrimSpace(config.SMTP.PassFile) != "" {
+		if config.SMTP.Pass, err = readSecretFile(config.SMTP.PassFile); err != nil {
+			setupFailed(fmt.Errorf("smtp.pass_file: %w", err))
+		}
+	}
+	if strings.TrimSpace(config.SMTP.OAuthTokenFile) != "" {
+		if config.SMTP.OAuthToken, err = readSecretFile(config.SMTP.OAuthTokenFile); err != nil {
+			setupFailed(fmt.Errorf("smtp.oauth_token_file: %w", err))
+		}
+	}
+	if config.SMTP.TLSInsecureSkipVerify {
+		logger.println("warning: smtp.tls_insecure_skip_verify is set; SMTP server certificates are not verified")
 	}
 
 	if *dbTest {
@@ -193,682 +626,4876 @@ func main() {
 	}
 	if *mailTest {
 		debugf(*debug, "mail test: building message")
+		if err := renderSubjects(&config.SMTP, subjectData{Query: config.SQL, Now: time.Now(), Format: config.Output}); err != nil {
+			fatal(err)
+		}
 		body := "Mail test OK."
-		if err := sendMail(config.SMTP, body, "text/plain; charset=\"utf-8\"", nil, *debug); err != nil {
+		err := sendMail(config.SMTP, body, "text/plain; charset=\"utf-8\"", nil, *debug)
+		sharedSMTP.close(*debug)
+		if err != nil {
 			fatal(err)
 		}
 		fmt.Println("mail send OK")
 		return
 	}
 
-	columns, rows, err := runQuery(config.DB, config.SQL)
+	cycle := func() error {
+		var err error
+		if len(config.Jobs) > 0 {
+			err = runJobs(config, options)
+		} else {
+			err = runWithFailureNotice(config, options)
+		}
+		sharedSMTP.close(*debug)
+		return err
+	}
+	if strings.TrimSpace(config.Schedule) != "" {
+		err = runScheduled(config.Schedule, cycle, *debug)
+	} else {
+		err = cycle()
+	}
 	if err != nil {
 		fatal(err)
 	}
+}
 
-	result, contentType, attachment, err := renderOutput(config.Output, columns, rows)
+func runWithFailureNotice(config Config, options runOptions) error {
+	start := time.Now()
+	options.Stats = &runStats{Rows: -1}
+	err := run(config, options)
 	if err != nil {
-		fatal(err)
+		if failureErr := notifyFailure(config, err, options.Debug); failureErr != nil {
+			logger.println(failureErr)
+		}
 	}
-
-	mailBody := buildMailBody(config.SQL, result, config.Output, contentType, showQuery)
-	if err := sendMail(config.SMTP, mailBody, contentType, attachment, *debug); err != nil {
-		fatal(err)
+	if options.MetricLine {
+		fmt.Println(metricLine(options, time.Since(start), err))
+	}
+	if options.LogJSON {
+		logger.event(newRunEvent(config, options, start, err))
 	}
+	return err
 }
 
-func loadConfig(path string, required bool) (Config, error) {
-	var config Config
-	info, err := os.Stat(path)
+// metricLine is a stable key=value summary meant for shell scraping; rows is
+// -1 when the run failed before a result was available.
+func metricLine(options runOptions, duration time.Duration, err error) string {
+	line := "notifysql"
+	if options.Job != "" {
+		line += " job=" + strconv.Quote(options.Job)
+	}
+	status := "ok"
 	if err != nil {
-		if os.IsNotExist(err) && !required {
-			return config, nil
+		status = "failed"
+	}
+	return fmt.Sprintf("%s rows=%d duration_ms=%d sent=%t status=%s", line, options.Stats.Rows, duration.Milliseconds(), options.Stats.Sent, status)
+}
+
+func selectJob(jobs []JobConfig, name string) ([]JobConfig, error) {
+	for _, job := range jobs {
+		if strings.TrimSpace(job.Name) == name {
+			return []JobConfig{job}, nil
 		}
-		return config, fmt.Errorf("config read failed: %w", err)
 	}
-	if info.IsDir() {
-		return config, fmt.Errorf("config path is a directory: %s", path)
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("-job %s: config has no [[job]] entries", name)
 	}
-	if _, err := toml.DecodeFile(path, &config); err != nil {
-		return config, fmt.Errorf("config decode failed: %w", err)
+	return nil, fmt.Errorf("-job %s: no such job", name)
+}
+
+func jobConfig(config Config, job JobConfig) Config {
+	config.Jobs = nil
+	config.SQL = job.SQL
+	config.Output = overrideString(config.Output, job.Output)
+	if len(job.To) > 0 {
+		config.SMTP.To = job.To
+		config.SMTP.RecipientsQuery = ""
 	}
-	return config, nil
+	if len(job.Cc) > 0 {
+		config.SMTP.Cc = job.Cc
+	}
+	if len(job.Bcc) > 0 {
+		config.SMTP.Bcc = job.Bcc
+	}
+	config.SMTP.Subject = overrideString(config.SMTP.Subject, job.Subject)
+	return config
 }
 
-func validateConfig(config Config, mailTest bool, dbTest bool) error {
-	if strings.TrimSpace(config.Output) != "" {
-		if _, err := normalizeOutput(config.Output); err != nil {
-			return err
+// runConcurrently calls run for every index below count on up to
+// concurrency goroutines (at least one) and returns each call's error at its
+// index. A failing call does not stop the others.
+func runConcurrently(count int, concurrency int, run func(i int) error) []error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > count {
+		concurrency = count
+	}
+	results := make([]error, count)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = run(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+func runJobs(config Config, options runOptions) error {
+	debugf(options.Debug, "jobs: running %d jobs with job_concurrency = %d", len(config.Jobs), config.JobConcurrency)
+	results := runConcurrently(len(config.Jobs), config.JobConcurrency, func(i int) error {
+		job := config.Jobs[i]
+		debugf(options.Debug, "job %s: start", job.Name)
+		jobOptions := options
+		jobOptions.Job = job.Name
+		return runWithFailureNotice(jobConfig(config, job), jobOptions)
+	})
+
+	failed := 0
+	for i, err := range results {
+		if err != nil {
+			failed++
+			logger.errorf("job %s: failed: %v", config.Jobs[i].Name, err)
+			continue
 		}
+		fmt.Printf("job %s: ok\n", config.Jobs[i].Name)
 	}
-	if !mailTest && !dbTest {
-		if strings.TrimSpace(config.SQL) == "" {
-			return errors.New("sql query is required (use -sql or config sql)")
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(config.Jobs))
+	}
+	return nil
+}
+
+func run(config Config, options runOptions) error {
+	var queryResult QueryResult
+	config.DB.Setup = config.Statements
+	config.DB.AllResultSets = config.AllResultSets
+	params, err := queryParameters(config, time.Now())
+	if err != nil {
+		return err
+	}
+	useWatermark := strings.TrimSpace(config.WatermarkColumn) != "" && options.RenderFrom == ""
+	if useWatermark {
+		state, err := loadJobState(config.StateFile, options.Job)
+		if err != nil {
+			return err
 		}
-		if strings.TrimSpace(config.DB.Type) == "" {
-			return errors.New("db.type is required")
+		value := state.Watermark
+		if value == "" {
+			value = strings.TrimSpace(config.WatermarkSeed)
 		}
-		if strings.TrimSpace(config.SMTP.Host) == "" {
-			return errors.New("smtp.host is required")
+		debugf(options.Debug, "watermark: %s > %s", config.WatermarkColumn, value)
+		params.Named["watermark"] = watermarkParam(value)
+	}
+	if strings.TrimSpace(config.SMTP.RecipientsQuery) != "" && options.RenderFrom == "" && sendsEmail(config) {
+		recipients, err := runRecipientsQuery(config.DB, config.SMTP.RecipientsQuery, params)
+		if err != nil {
+			return err
 		}
-		if config.SMTP.Port == 0 {
-			return errors.New("smtp.port is required")
+		debugf(options.Debug, "recipients query: %d recipients", len(recipients))
+		config.SMTP.To = recipients
+	}
+	rowCount := -1
+	if (config.InlineMaxRows > 0 || options.CountOnly) && strings.TrimSpace(config.CountQuery) != "" && options.RenderFrom == "" {
+		rowCount, err = runCountQuery(config.DB, config.CountQuery, params)
+		if err != nil {
+			return err
 		}
-		if strings.TrimSpace(config.SMTP.From) == "" {
-			return errors.New("smtp.from is required")
+		debugf(options.Debug, "count query: rows=%d", rowCount)
+		if options.CountOnly {
+			return deliverCount(config, options, rowCount)
 		}
-		if len(config.SMTP.To) == 0 {
-			return errors.New("smtp.to is required")
+	}
+	backends, err := normalizeNotify(config.Notify)
+	if err != nil {
+		return err
+	}
+	if options.RenderFrom != "" {
+		debugf(options.Debug, "render: loading %s", options.RenderFrom)
+		queryResult, err = loadRenderInput(options.RenderFrom)
+	} else if rowCount >= 0 && streamsCSV(config, options, backends, deliveryFormat(config, rowCount, false)) {
+		debugf(options.Debug, "count query: streaming the result into the csv attachment")
+		sink := &csvSink{config: config, csv: newCSVWriter(config)}
+		format := newFormatOptions(config)
+		format.Sink = sink
+		if queryResult, err = runQuery(config.DB, config.SQL, format, config.MaxRowsFetched, params); err == nil {
+			queryResult.StreamedCSV, err = sink.csv.finish()
 		}
-		return nil
+	} else if len(config.Sources) > 0 {
+		queryResult, err = runSourcesQuery(config, params, options.Debug)
+	} else if config.FetchAllPages {
+		queryResult, err = runPagedQuery(config, params, options.Debug)
+	} else {
+		queryResult, err = runQuery(config.DB, config.SQL, newFormatOptions(config), config.MaxRowsFetched, params)
 	}
-	if dbTest {
-		if strings.TrimSpace(config.DB.Type) == "" {
-			return errors.New("db.type is required")
+	if err != nil {
+		return err
+	}
+	for _, warning := range queryResult.Warnings {
+		debugf(options.Debug, "db warning: %s", warning)
+	}
+	if queryResult.Truncated {
+		debugf(options.Debug, "query: stopped after max_rows_fetched=%d rows", config.MaxRowsFetched)
+	}
+	if options.CountOnly {
+		if queryResult.Truncated {
+			return fmt.Errorf("-count-only: max_rows_fetched=%d stopped the query, so the count would be at least %d; set count_query for an exact count", config.MaxRowsFetched, queryResult.rowCount())
 		}
+		return deliverCount(config, options, queryResult.rowCount())
 	}
-	if mailTest {
-		if strings.TrimSpace(config.SMTP.Host) == "" {
-			return errors.New("smtp.host is required")
+	var nextWatermark string
+	if useWatermark {
+		if nextWatermark, err = watermarkValue(queryResult, config.WatermarkColumn); err != nil {
+			return err
 		}
-		if config.SMTP.Port == 0 {
-			return errors.New("smtp.port is required")
+	}
+	for _, set := range append([]QueryResult{queryResult}, queryResult.ResultSets...) {
+		humanizeResult(config.HumanizeColumns, set)
+		applyColumnRules(config, set)
+	}
+	if rowCount < 0 {
+		rowCount = queryResult.rowCount()
+	}
+	config.Output = deliveryFormat(config, rowCount, options.Debug)
+	if err := renderSubjects(&config.SMTP, subjectData{RowCount: rowCount, Query: config.SQL, Now: time.Now(), Format: config.Output}); err != nil {
+		return err
+	}
+
+	rowTotal := queryResult.rowCount()
+	options.Stats.Rows = rowTotal
+	// A dry run or a -n preview never touches state_file: the full result
+	// was not sent, so it must neither count as alerted nor move the watermark.
+	persistState := !options.DryRun && options.Preview <= 0
+	trackState := config.SuppressDuplicates && persistState
+	var previous jobState
+	var hash string
+	if trackState {
+		hash = resultHash(queryResult)
+		if previous, err = loadJobState(config.StateFile, options.Job); err != nil {
+			return err
 		}
-		if strings.TrimSpace(config.SMTP.From) == "" {
-			return errors.New("smtp.from is required")
+	}
+	emailSent := false
+	// The watermark only moves once the rows went out through a backend or
+	// output_file, so rows from a failed or skipped run are reported again.
+	delivered := false
+	saveState := func() error {
+		if !persistState || (!trackState && (nextWatermark == "" || !delivered)) {
+			return nil
 		}
-		if len(config.SMTP.To) == 0 {
-			return errors.New("smtp.to is required")
+		return updateJobState(config.StateFile, options.Job, func(state *jobState) {
+			if trackState && !emailSent {
+				state.unsent(hash)
+			}
+			if nextWatermark != "" && delivered {
+				state.Watermark = nextWatermark
+			}
+		})
+	}
+	options.Stats.Output = config.Output
+	queryResult = previewRows(queryResult, options.Preview)
+	if path := strings.TrimSpace(config.OutputFile); path != "" {
+		if options.DryRun {
+			content, err := outputFileContent(config, queryResult)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("dry-run: would write %d bytes to %s\n", len(content), path)
+		} else {
+			written, err := writeOutputFile(config, queryResult, path)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("wrote %d bytes to %s\n", written, path)
+			delivered = true
 		}
 	}
-	return nil
-}
-
-func testDB(config DBConfig, debug bool) error {
-	dsn, driver, err := buildDSN(config)
-	if err != nil {
-		return err
+	if !notifyOnAllows(config.NotifyOn, rowTotal) {
+		debugf(options.Debug, "notify_on=%s: nothing to deliver (rows=%d)", config.NotifyOn, rowTotal)
+		return saveState()
 	}
-	debugf(debug, "db test: open driver=%s", driver)
-	db, err := sql.Open(driver, dsn)
-	if err != nil {
-		return fmt.Errorf("db open failed: %w", err)
+	inWindow := rowWindowAllows(config, rowTotal)
+	if !inWindow {
+		fmt.Printf("skipped: %d rows outside min_rows=%d max_rows=%d\n", rowTotal, config.MinRows, config.MaxRows)
 	}
-	defer db.Close()
-	debugf(debug, "db test: ping")
-	if err := db.Ping(); err != nil {
-		return fmt.Errorf("db ping failed: %w", err)
+	for _, backend := range backends {
+		if backend != "opsgenie" && (!inWindow || !backendRule(config, backend).allows(rowTotal)) {
+			debugf(options.Debug, "%s: skipped by notify rule (rows=%d)", backend, rowTotal)
+			continue
+		}
+		if options.DryRun && backend != "email" {
+			fmt.Printf("dry-run: skipping %s\n", backend)
+			continue
+		}
+		switch backend {
+		case "email":
+			if strings.TrimSpace(config.OutputFile) != "" && !config.SMTP.mailEnabled() {
+				continue
+			}
+			if trackState && previous.suppresses(hash, resendAfter(config), time.Now()) {
+				fmt.Printf("skipped: result unchanged since the alert sent at %s\n", previous.SentAt.Local().Format(time.RFC3339))
+				continue
+			}
+			if options.RenderFrom != "" && !config.SMTP.mailEnabled() {
+				err = printReport(config, queryResult, params, options.ShowQuery)
+			} else if err = sendReport(config, queryResult, params, options.ShowQuery, options.Debug); err == nil && trackState {
+				emailSent = true
+				err = updateJobState(config.StateFile, options.Job, func(state *jobState) {
+					sentAt := time.Now().UTC()
+					state.Hash = hash
+					state.SentAt = &sentAt
+				})
+			}
+		case "nats":
+			err = publishNATS(config.NATS, queryResult, options.Debug)
+		case "webhook":
+			err = sendWebhook(config.Webhook, config.SQL, queryResult, options.Debug)
+		case "opsgenie":
+			err = sendOpsgenie(config, queryResult, thresholdMet(config, queryResult), options.Debug)
+		case "github":
+			err = sendGitHub(config, queryResult, options.ShowQuery, options.Debug)
+		case "slack":
+			err = sendSlack(config, queryResult, options.Debug)
+		}
+		if err != nil {
+			return err
+		}
+		options.Stats.Sent = !options.DryRun
+		delivered = !options.DryRun
 	}
-	return nil
+	return saveState()
 }
 
-func runQuery(config DBConfig, query string) ([]string, [][]string, error) {
-	dsn, driver, err := buildDSN(config)
-	if err != nil {
-		return nil, nil, err
+// rowCount is the number of rows the query returned, before any -n cut.
+func (data QueryResult) rowCount() int {
+	if data.PreviewOf > 0 {
+		return data.PreviewOf
 	}
+	return len(data.Rows) + data.StreamedRows
+}
 
-	db, err := sql.Open(driver, dsn)
-	if err != nil {
-		return nil, nil, fmt.Errorf("db open failed: %w", err)
+// streamsCSV reports whether the main query can be written straight into
+// the csv attachment once count_query has picked it: only email is sent and
+// nothing else in the run needs the rows in memory.
+func streamsCSV(config Config, options runOptions, backends []string, output string) bool {
+	if format, err := normalizeOutput(output); err != nil || format != "csv" {
+		return false
 	}
-	defer db.Close()
-
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, nil, fmt.Errorf("query failed: %w", err)
+	if len(backends) != 1 || backends[0] != "email" || options.Preview > 0 {
+		return false
 	}
-	defer rows.Close()
+	return len(config.Sources) == 0 && !config.FetchAllPages && !config.AllResultSets &&
+		strings.TrimSpace(config.WatermarkColumn) == "" && !config.SuppressDuplicates &&
+		strings.TrimSpace(config.OutputFile) == "" && strings.TrimSpace(config.SplitAttachmentBy) == "" &&
+		len(config.ExtraAttachments) == 0 && strings.TrimSpace(config.BodyTemplateFile) == ""
+}
 
-	columns, err := rows.Columns()
-	if err != nil {
-		return nil, nil, fmt.Errorf("columns read failed: %w", err)
+// previewRows keeps the first n rows of every result set for -n. Row-count
+// rules have already seen the full result by the time it is cut.
+func previewRows(data QueryResult, n int) QueryResult {
+	if n <= 0 {
+		return data
 	}
-	var rowData [][]string
-	for rows.Next() {
-		values := make([]interface{}, len(columns))
-		pointers := make([]interface{}, len(columns))
-		for i := range values {
-			pointers[i] = &values[i]
+	if len(data.Rows) > n {
+		data.PreviewOf = len(data.Rows)
+		data.Rows = data.Rows[:n]
+		if len(data.Nulls) > n {
+			data.Nulls = data.Nulls[:n]
 		}
-		if err := rows.Scan(pointers...); err != nil {
-			return nil, nil, fmt.Errorf("row scan failed: %w", err)
+		if len(data.Values) > n {
+			data.Values = data.Values[:n]
 		}
-		row := make([]string, len(columns))
-		for i, value := range values {
-			row[i] = formatValue(value)
+	}
+	if len(data.ResultSets) > 0 {
+		sets := make([]QueryResult, len(data.ResultSets))
+		for i, set := range data.ResultSets {
+			sets[i] = previewRows(set, n)
 		}
-		rowData = append(rowData, row)
+		data.ResultSets = sets
 	}
-	if err := rows.Err(); err != nil {
-		return nil, nil, fmt.Errorf("row iterate failed: %w", err)
+	return data
+}
+
+// watermarkParam binds RFC 3339 watermarks as timestamps so they compare
+// against date/time columns; anything else is typed like a -param value.
+func watermarkParam(value string) interface{} {
+	if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return parsed
 	}
-	return columns, rowData, nil
+	return parseParamValue(value)
 }
 
-func buildDSN(config DBConfig) (string, string, error) {
-	if strings.TrimSpace(config.DSN) != "" {
-		switch strings.ToLower(config.Type) {
-		case "mysql", "mariadb":
-			return config.DSN, "mysql", nil
-		case "postgres", "postgresql", "pgx":
-			return config.DSN, "pgx", nil
-		case "mssql", "sqlserver":
-			return config.DSN, "sqlserver", nil
-		case "clickhouse":
-			return config.DSN, "clickhouse", nil
-		default:
-			return "", "", fmt.Errorf("unsupported db.type: %s", config.Type)
+// watermarkValue returns the largest non-NULL value of column. It works on
+// the scanned values, not the formatted cells, so number_format and
+// datetime_format cannot skew it: times compare as times, numbers as
+// numbers, and anything else as text. Times are stored as RFC 3339 and
+// numbers in plain notation, which watermarkParam binds back with their
+// type. It is empty when there are no rows, which keeps the stored watermark.
+func watermarkValue(data QueryResult, column string) (string, error) {
+	index := -1
+	for i, name := range data.Columns {
+		if strings.EqualFold(name, strings.TrimSpace(column)) {
+			index = i
 		}
 	}
-
-	switch strings.ToLower(config.Type) {
-	case "mysql", "mariadb":
-		port := config.Port
-		if port == 0 {
-			port = 3306
+	if index < 0 {
+		return "", fmt.Errorf("watermark_column %s not found in result", column)
+	}
+	var times []time.Time
+	var numbers []*big.Rat
+	var texts []string
+	for _, values := range data.Values {
+		switch value := values[index].(type) {
+		case nil:
+		case time.Time:
+			times = append(times, value)
+		default:
+			text := formatValue(value, formatOptions{DatetimeFormat: time.RFC3339Nano})
+			texts = append(texts, text)
+			if number, ok := new(big.Rat).SetString(text); ok && reflect.ValueOf(value).Kind() != reflect.Bool {
+				numbers = append(numbers, number)
+			}
 		}
-		if strings.TrimSpace(config.Host) == "" {
-			return "", "", errors.New("db.host is required")
+	}
+	switch {
+	case len(times) > 0 && len(texts) == 0:
+		highest := times[0]
+		for _, value := range times[1:] {
+			if value.After(highest) {
+				highest = value
+			}
 		}
-		if strings.TrimSpace(config.User) == "" {
-			return "", "", errors.New("db.user is required")
+		return highest.Format(time.RFC3339Nano), nil
+	case len(numbers) > 0 && len(numbers) == len(texts) && len(times) == 0:
+		highest := 0
+		for i, number := range numbers {
+			if number.Cmp(numbers[highest]) > 0 {
+				highest = i
+			}
 		}
-		if strings.TrimSpace(config.Name) == "" {
-			return "", "", errors.New("db.name is required")
+		return texts[highest], nil
+	}
+	for _, value := range times {
+		texts = append(texts, value.Format(time.RFC3339Nano))
+	}
+	highest := ""
+	for _, value := range texts {
+		if value > highest {
+			highest = value
+		}
+	}
+	return highest, nil
+}
+
+// resendAfter has been validated by validateConfig.
+func resendAfter(config Config) time.Duration {
+	if strings.TrimSpace(config.ResendAfter) == "" {
+		return 0
+	}
+	duration, _ := time.ParseDuration(strings.TrimSpace(config.ResendAfter))
+	return duration
+}
+
+const defaultCountMessage = "Query returned {{.RowCount}} rows."
+
+// deliverCount is the -count-only counterpart of the backend loop in run:
+// only email is sent, with count_message as the body. validateConfig rejects
+// -count-only with any other backend.
+func deliverCount(config Config, options runOptions, count int) error {
+	options.Stats.Rows = count
+	options.Stats.Output = "count"
+	if !notifyOnAllows(config.NotifyOn, count) {
+		debugf(options.Debug, "notify_on=%s: nothing to deliver (rows=%d)", config.NotifyOn, count)
+		return nil
+	}
+	if !rowWindowAllows(config, count) {
+		fmt.Printf("skipped: %d rows outside min_rows=%d max_rows=%d\n", count, config.MinRows, config.MaxRows)
+		return nil
+	}
+	data := subjectData{RowCount: count, Query: config.SQL, Now: time.Now(), Format: "count"}
+	if err := renderSubjects(&config.SMTP, data); err != nil {
+		return err
+	}
+	message := config.CountMessage
+	if strings.TrimSpace(message) == "" {
+		message = defaultCountMessage
+	}
+	tmpl, err := template.New("count_message").Parse(message)
+	if err != nil {
+		return fmt.Errorf("count_message parse failed: %w", err)
+	}
+	var body strings.Builder
+	if err := tmpl.Execute(&body, data); err != nil {
+		return fmt.Errorf("count_message render failed: %w", err)
+	}
+	if options.ShowQuery {
+		body.WriteString("\n\nSQL Query:\n" + config.SQL)
+	}
+	backends, err := normalizeNotify(config.Notify)
+	if err != nil {
+		return err
+	}
+	for _, backend := range backends {
+		if !backendRule(config, backend).allows(count) {
+			debugf(options.Debug, "email: skipped by notify rule (rows=%d)", count)
+			continue
+		}
+		smtpConfig := config.SMTP
+		if count == 0 && strings.TrimSpace(smtpConfig.SubjectEmpty) != "" {
+			smtpConfig.Subject = smtpConfig.SubjectEmpty
+		}
+		if !smtpConfig.mailEnabled() {
+			fmt.Println(body.String())
+		} else if err := sendMail(smtpConfig, body.String(), textPlain, nil, options.Debug); err != nil {
+			return err
+		}
+		options.Stats.Sent = !options.DryRun
+	}
+	return nil
+}
+
+// writeOutputFile saves the rendered result: the attachment bytes for csv,
+// json, xlsx and pdf, the rendered body for the inline formats.
+func writeOutputFile(config Config, data QueryResult, path string) (int, error) {
+	content, err := outputFileContent(config, data)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return 0, fmt.Errorf("output file write failed: %w", err)
+	}
+	return len(content), nil
+}
+
+// outputFileContent renders the bytes writeOutputFile would save. With no
+// rows the attachment formats still produce their empty file (a csv header,
+// an empty json array) rather than the "No rows returned." body.
+func outputFileContent(config Config, data QueryResult) ([]byte, error) {
+	config.ExtraAttachments = nil
+	if data.rowCount() == 0 && len(data.ResultSets) == 0 {
+		format, err := normalizeOutput(config.Output)
+		if err != nil {
+			return nil, err
+		}
+		_, _, attachments, err := renderers[format].Render(config, fillNulls(config, format, data))
+		if err != nil {
+			return nil, err
+		}
+		if len(attachments) == 1 {
+			if err := finishAttachments(config, attachments); err != nil {
+				return nil, err
+			}
+			return attachments[0].Data, nil
+		}
+	}
+	body, _, attachments, err := renderOutput(config, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) > 1 {
+		return nil, errors.New("output_file needs a single result file; it cannot be combined with split_attachment_by or all_result_sets")
+	}
+	if len(attachments) == 1 {
+		return attachments[0].Data, nil
+	}
+	return []byte(body), nil
+}
+
+func backendRule(config Config, backend string) NotifyRule {
+	switch backend {
+	case "email":
+		return config.SMTP.NotifyRule
+	case "nats":
+		return config.NATS.NotifyRule
+	case "webhook":
+		return config.Webhook.NotifyRule
+	case "opsgenie":
+		return config.Opsgenie.NotifyRule
+	case "github":
+		return config.GitHub.NotifyRule
+	case "slack":
+		return config.Slack.NotifyRule
+	}
+	return NotifyRule{}
+}
+
+// thresholdMet decides whether the Opsgenie alert is raised or, with
+// close_on_clear, closed: the result must have rows, fall inside the
+// min_rows/max_rows window and pass the [opsgenie] notify rule.
+func thresholdMet(config Config, data QueryResult) bool {
+	count := data.rowCount()
+	return count > 0 && rowWindowAllows(config, count) && config.Opsgenie.allows(count)
+}
+
+// rowWindowAllows checks the inclusive min_rows/max_rows window; 0 leaves
+// that side open.
+func rowWindowAllows(config Config, rowCount int) bool {
+	if config.MinRows > 0 && rowCount < config.MinRows {
+		return false
+	}
+	return config.MaxRows <= 0 || rowCount <= config.MaxRows
+}
+
+func runCountQuery(config DBConfig, query string, params queryParams) (int, error) {
+	// The statements list prepares the main query, not this one, and the
+	// positional params fill the main query's placeholders, so only the
+	// named parameters are bound here.
+	config.Setup = nil
+	result, err := runQuery(config, query, formatOptions{}, 0, queryParams{Named: params.Named})
+	if err != nil {
+		return 0, fmt.Errorf("count query: %w", err)
+	}
+	if len(result.Rows) == 0 || len(result.Rows[0]) == 0 {
+		return 0, errors.New("count query returned no value")
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(result.Rows[0][0]))
+	if err != nil {
+		return 0, fmt.Errorf("count query returned a non-integer value: %s", result.Rows[0][0])
+	}
+	return count, nil
+}
+
+// sendsEmail reports whether the run can end in a mail: email is one of
+// the notify backends and output_file does not stand in for an unset
+// smtp.host.
+func sendsEmail(config Config) bool {
+	backends, err := normalizeNotify(config.Notify)
+	if err != nil {
+		return false
+	}
+	for _, backend := range backends {
+		if backend == "email" {
+			return strings.TrimSpace(config.OutputFile) == "" || config.SMTP.mailEnabled()
+		}
+	}
+	return false
+}
+
+// runRecipientsQuery reads smtp.recipients_query and returns the distinct
+// addresses from its first column.
+func runRecipientsQuery(config DBConfig, query string, params queryParams) ([]string, error) {
+	config.Setup = nil
+	result, err := runQuery(config, query, formatOptions{}, 0, queryParams{Named: params.Named})
+	if err != nil {
+		return nil, fmt.Errorf("recipients query: %w", err)
+	}
+	var recipients []string
+	seen := map[string]bool{}
+	for _, row := range result.Rows {
+		if len(row) == 0 {
+			continue
+		}
+		address := strings.TrimSpace(row[0])
+		if address == "" || seen[strings.ToLower(address)] {
+			continue
+		}
+		if _, err := mail.ParseAddress(address); err != nil || strings.ContainsAny(address, "\r\n") {
+			return nil, fmt.Errorf("recipients query returned an invalid address: %q", address)
+		}
+		seen[strings.ToLower(address)] = true
+		recipients = append(recipients, address)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("recipients query returned no recipients")
+	}
+	return recipients, nil
+}
+
+func deliveryFormat(config Config, rowCount int, debug bool) string {
+	if config.InlineMaxRows <= 0 || rowCount <= config.InlineMaxRows {
+		return config.Output
+	}
+	format, err := normalizeOutput(config.Output)
+	if err != nil || (format != "table" && format != "text" && format != "table-text" && format != "markdown" && format != "html") {
+		return config.Output
+	}
+	debugf(debug, "output: %d rows exceed inline_max_rows=%d, attaching csv", rowCount, config.InlineMaxRows)
+	return "csv"
+}
+
+func notifyFailure(config Config, runErr error, debug bool) error {
+	failure := config.OnFailure
+	if len(failure.To) == 0 && strings.TrimSpace(failure.WebhookURL) == "" {
+		return nil
+	}
+	var errs []error
+	if len(failure.To) > 0 {
+		smtpConfig := config.SMTP
+		smtpConfig.To = failure.To
+		smtpConfig.Cc = failure.Cc
+		smtpConfig.Bcc = failure.Bcc
+		smtpConfig.Subject = failure.Subject
+		if strings.TrimSpace(smtpConfig.Subject) == "" {
+			smtpConfig.Subject = "notifysql run failed"
+		}
+		body := fmt.Sprintf("notifysql run failed.\n\nError:\n%s\n\nSQL Query:\n%s", runErr, config.SQL)
+		debugf(debug, "on_failure: sending failure mail")
+		if err := sendMail(smtpConfig, body, "text/plain; charset=\"utf-8\"", nil, debug); err != nil {
+			errs = append(errs, fmt.Errorf("failure mail failed: %w", err))
+		}
+	}
+	if strings.TrimSpace(failure.WebhookURL) != "" {
+		payload := map[string]interface{}{
+			"status": "failed",
+			"error":  runErr.Error(),
+			"query":  config.SQL,
+			"time":   time.Now().UTC().Format(time.RFC3339),
+		}
+		if config.SMTP.DryRun {
+			if err := printFailureWebhook(failure.WebhookURL, payload); err != nil {
+				errs = append(errs, err)
+			}
+			return errors.Join(errs...)
+		}
+		debugf(debug, "on_failure: posting failure webhook")
+		if err := postJSON(failure.WebhookURL, payload, nil); err != nil {
+			errs = append(errs, fmt.Errorf("failure webhook failed: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// printFailureWebhook shows the on_failure webhook payload under -dry-run.
+// Only the webhook's scheme and host are printed, since the path of a chat
+// webhook is its secret.
+func printFailureWebhook(webhookURL string, payload map[string]interface{}) error {
+	target := "webhook"
+	if parsed, err := url.Parse(strings.TrimSpace(webhookURL)); err == nil && parsed.Host != "" {
+		target = parsed.Scheme + "://" + parsed.Host
+	}
+	encoded, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("dry-run: would post failure webhook to %s\n%s\n", target, encoded)
+	return nil
+}
+
+func sendReport(config Config, data QueryResult, params queryParams, showQuery bool, debug bool) error {
+	result, contentType, attachments, err := renderOutput(config, data)
+	if err != nil {
+		return err
+	}
+	smtpConfig := reportSMTP(config, data)
+	mailBody, contentType, err := reportBody(config, data, params, messageSubject(smtpConfig), result, contentType, attachments, showQuery)
+	if err != nil {
+		return err
+	}
+	if config.AttachmentChecksum && config.AttachmentChecksumHeader && len(attachments) > 0 {
+		smtpConfig.ExtraHeaders = withHeader(smtpConfig.ExtraHeaders, "X-Attachment-SHA256", checksumHeader(attachments))
+	}
+	if strings.HasPrefix(contentType, "text/html") && strings.TrimSpace(config.BodyTemplateFile) == "" {
+		// Text-only clients get the text rendering instead of raw table markup.
+		textConfig := config
+		textConfig.Output = "text"
+		text, textType, _, err := renderOutput(textConfig, data)
+		if err != nil {
+			return err
+		}
+		smtpConfig.TextAlternative = decorateBody(config, data, buildMailBody(newReportQuery(config, params), text, "text", textType, showQuery), textType, attachments)
+	}
+	return sendMail(smtpConfig, mailBody, contentType, attachments, debug)
+}
+
+// reportSMTP is the smtp config a report is sent with: subject_empty
+// replaces subject when the query returned no rows.
+func reportSMTP(config Config, data QueryResult) SMTPConfig {
+	smtpConfig := config.SMTP
+	if data.rowCount() == 0 && strings.TrimSpace(smtpConfig.SubjectEmpty) != "" {
+		smtpConfig.Subject = smtpConfig.SubjectEmpty
+	}
+	return smtpConfig
+}
+
+// reportBody lays out the mail body around the rendered result, or renders
+// body_template_file instead when one is configured. subject is the subject
+// the mail goes out with, for the template's .Subject.
+func reportBody(config Config, data QueryResult, params queryParams, subject string, result string, contentType string, attachments []*Attachment, showQuery bool) (string, string, error) {
+	if path := strings.TrimSpace(config.BodyTemplateFile); path != "" {
+		body, templateType, err := renderBodyTemplate(path, bodyTemplateData{
+			Columns:  data.Columns,
+			Rows:     fillNulls(config, "template", data).Rows,
+			RowCount: data.rowCount(),
+			Query:    config.SQL,
+			Subject:  subject,
+			Now:      time.Now(),
+		})
+		if err != nil {
+			return "", "", err
+		}
+		return decorateBody(config, data, body, templateType, attachments), templateType, nil
+	}
+	body := buildMailBody(newReportQuery(config, params), result, config.Output, contentType, showQuery)
+	return decorateBody(config, data, body, contentType, attachments), contentType, nil
+}
+
+type bodyTemplateData struct {
+	Columns  []string
+	Rows     [][]string
+	RowCount int
+	Query    string
+	Subject  string
+	Now      time.Time
+}
+
+func isHTMLTemplate(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm", ".gohtml":
+		return true
+	}
+	return false
+}
+
+// bodyTemplate is satisfied by both *text/template.Template and
+// *html/template.Template.
+type bodyTemplate interface {
+	Execute(io.Writer, any) error
+}
+
+// parseBodyTemplate uses html/template for .html, .htm and .gohtml files and
+// text/template for anything else.
+func parseBodyTemplate(path string) (bodyTemplate, bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("body_template_file read failed: %w", err)
+	}
+	if isHTMLTemplate(path) {
+		tmpl, err := htmltemplate.New(filepath.Base(path)).Parse(string(content))
+		if err != nil {
+			return nil, false, fmt.Errorf("body_template_file parse failed: %w", err)
+		}
+		return tmpl, true, nil
+	}
+	tmpl, err := template.New(filepath.Base(path)).Parse(string(content))
+	if err != nil {
+		return nil, false, fmt.Errorf("body_template_file parse failed: %w", err)
+	}
+	return tmpl, false, nil
+}
+
+func renderBodyTemplate(path string, data bodyTemplateData) (string, string, error) {
+	tmpl, isHTML, err := parseBodyTemplate(path)
+	if err != nil {
+		return "", "", err
+	}
+	var builder strings.Builder
+	if err := tmpl.Execute(&builder, data); err != nil {
+		return "", "", fmt.Errorf("body_template_file render failed: %w", err)
+	}
+	if isHTML {
+		return builder.String(), "text/html; charset=\"utf-8\"", nil
+	}
+	return builder.String(), textPlain, nil
+}
+
+func printReport(config Config, data QueryResult, params queryParams, showQuery bool) error {
+	result, contentType, attachments, err := renderOutput(config, data)
+	if err != nil {
+		return err
+	}
+	mailBody, contentType, err := reportBody(config, data, params, messageSubject(reportSMTP(config, data)), result, contentType, attachments, showQuery)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Content-Type: %s\n\n", contentType)
+	fmt.Println(mailBody)
+	for _, attachment := range attachments {
+		fmt.Printf("\n--- attachment %s (%s) ---\n", attachment.Filename, attachment.ContentType)
+		fmt.Println(string(attachment.Data))
+	}
+	return nil
+}
+
+func attachmentChecksum(attachment *Attachment) string {
+	sum := sha256.Sum256(attachment.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// decorateBody appends the optional footer sections to a rendered mail body.
+// Checksums are listed in sha256sum format so recipients can run sha256sum -c.
+func decorateBody(config Config, data QueryResult, body string, contentType string, attachments []*Attachment) string {
+	if config.ShowTiming && data.Elapsed > 0 {
+		body = appendLine(body, contentType, fmt.Sprintf("Executed in %.2fs", data.Elapsed.Seconds()))
+	}
+	if data.PreviewOf > 0 {
+		body = appendLine(body, contentType, fmt.Sprintf("Showing %d of %d rows.", len(data.Rows), data.PreviewOf))
+	}
+	if data.Truncated {
+		body = appendSection(body, contentType, "Note", []string{fmt.Sprintf("Showing the first %d rows; the query returned more (max_rows_fetched = %d).", len(data.Rows)+data.StreamedRows, config.MaxRowsFetched)})
+	}
+	if len(data.Warnings) > 0 {
+		body = appendSection(body, contentType, "Warnings", data.Warnings)
+	}
+	if config.AttachmentChecksum && len(attachments) > 0 {
+		var lines []string
+		for _, attachment := range attachments {
+			lines = append(lines, attachmentChecksum(attachment)+"  "+attachment.Filename)
+		}
+		body = appendSection(body, contentType, "Attachment SHA-256", lines)
+	}
+	return body
+}
+
+func appendLine(body string, contentType string, line string) string {
+	if strings.HasPrefix(contentType, "text/html") {
+		paragraph := "<p>" + html.EscapeString(line) + "</p>"
+		if strings.HasSuffix(body, "</body></html>") {
+			return strings.TrimSuffix(body, "</body></html>") + paragraph + "</body></html>"
+		}
+		return body + paragraph
+	}
+	return body + "\n\n" + line
+}
+
+func appendSection(body string, contentType string, title string, lines []string) string {
+	if strings.HasPrefix(contentType, "text/html") {
+		section := "<p><strong>" + html.EscapeString(title) + ":</strong></p><pre>" + html.EscapeString(strings.Join(lines, "\n")) + "</pre>"
+		if strings.HasSuffix(body, "</body></html>") {
+			return strings.TrimSuffix(body, "</body></html>") + section + "</body></html>"
+		}
+		return body + section
+	}
+	return body + "\n\n" + title + ":\n" + strings.Join(lines, "\n")
+}
+
+func checksumHeader(attachments []*Attachment) string {
+	if len(attachments) == 1 {
+		return attachmentChecksum(attachments[0])
+	}
+	parts := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		parts[i] = attachment.Filename + "=" + attachmentChecksum(attachment)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func withHeader(headers map[string]string, key string, value string) map[string]string {
+	merged := make(map[string]string, len(headers)+1)
+	for name, existing := range headers {
+		merged[name] = existing
+	}
+	merged[key] = value
+	return merged
+}
+
+func loadConfig(path string, required bool) (Config, error) {
+	var config Config
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return config, nil
+		}
+		return config, fmt.Errorf("config read failed: %w", err)
+	}
+	if info.IsDir() {
+		return config, fmt.Errorf("config path is a directory: %s", path)
+	}
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return config, fmt.Errorf("config decode failed: %w", err)
+	}
+	return config, nil
+}
+
+func validateConfig(config Config, options runOptions) error {
+	mailTest := options.MailTest
+	dbTest := options.DBTest
+	if config.JobConcurrency < 0 {
+		return errors.New("job_concurrency must not be negative")
+	}
+	if config.SuppressDuplicates && strings.TrimSpace(config.StateFile) == "" {
+		return errors.New("suppress_duplicates requires state_file")
+	}
+	if strings.TrimSpace(config.WatermarkColumn) != "" {
+		if strings.TrimSpace(config.StateFile) == "" {
+			return errors.New("watermark_column requires state_file")
+		}
+		if strings.TrimSpace(config.WatermarkSeed) == "" {
+			return errors.New("watermark_column requires watermark_seed for the first run")
+		}
+	}
+	if value := strings.TrimSpace(config.ResendAfter); value != "" {
+		if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+			return fmt.Errorf("resend_after must be a positive duration such as 6h: %s", config.ResendAfter)
+		}
+	}
+	if spec := strings.TrimSpace(config.Schedule); spec != "" {
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+		if mailTest || dbTest || options.DryRun {
+			return errors.New("schedule cannot be combined with -test-mail, -test-db or -dry-run")
+		}
+	}
+	if len(config.Jobs) > 0 && !mailTest && !dbTest && options.RenderFrom == "" {
+		if len(config.Jobs) > 1 && strings.TrimSpace(config.OutputFile) != "" {
+			return errors.New("output_file would be overwritten by every [[job]]; select one job with -job")
+		}
+		names := map[string]bool{}
+		for i, job := range config.Jobs {
+			name := strings.TrimSpace(job.Name)
+			if name == "" {
+				return fmt.Errorf("job[%d].name is required", i)
+			}
+			if names[name] {
+				return fmt.Errorf("duplicate job name: %s", name)
+			}
+			names[name] = true
+			if err := validateConfig(jobConfig(config, job), options); err != nil {
+				return fmt.Errorf("job %s: %w", name, err)
+			}
+		}
+		return nil
+	}
+	if strings.TrimSpace(config.Output) != "" {
+		if _, err := normalizeOutput(config.Output); err != nil {
+			return err
+		}
+	}
+	if strings.TrimSpace(config.SplitAttachmentBy) != "" {
+		if format, _ := normalizeOutput(config.Output); format != "csv" && config.InlineMaxRows <= 0 && strings.TrimSpace(config.CountQuery) == "" {
+			return fmt.Errorf("split_attachment_by only applies to csv output, not %s", format)
+		}
+	}
+	for _, name := range config.ExtraAttachments {
+		if _, err := normalizeOutput(name); err != nil {
+			return fmt.Errorf("extra_attachments: %w", err)
+		}
+	}
+	if err := validateCSVDelimiter(config.CSVDelimiter); err != nil {
+		return err
+	}
+	if _, err := attachmentBase(config, QueryResult{}, "csv"); err != nil {
+		return err
+	}
+	for field, values := range map[string][]string{
+		"on_failure.to":      config.OnFailure.To,
+		"on_failure.cc":      config.OnFailure.Cc,
+		"on_failure.bcc":     config.OnFailure.Bcc,
+		"on_failure.subject": {config.OnFailure.Subject},
+	} {
+		if err := singleLine(field, values...); err != nil {
+			return err
+		}
+	}
+	if _, charset, err := outputEncoding(config.OutputEncoding); err != nil {
+		return err
+	} else if config.CSVBOM && charset != "utf-8" {
+		return fmt.Errorf("csv_bom requires utf-8 output, not %s", charset)
+	}
+	if _, err := namedParams(config, time.Now()); err != nil {
+		return err
+	}
+	for column, unit := range config.HumanizeColumns {
+		switch strings.ToLower(strings.TrimSpace(unit)) {
+		case "duration", "bytes", "count":
+		default:
+			return fmt.Errorf("humanize_columns.%s: unsupported unit %s (use duration, bytes or count)", column, unit)
+		}
+	}
+	for i, rule := range config.ColumnRules {
+		if strings.TrimSpace(rule.Name) == "" {
+			return fmt.Errorf("column[%d]: name is required", i)
+		}
+		switch strings.ToLower(strings.TrimSpace(rule.Align)) {
+		case "", "left", "right", "center":
+		default:
+			return fmt.Errorf("column %s: align must be left, right or center", rule.Name)
+		}
+		if err := validateColumnFormat(rule.Format); err != nil {
+			return fmt.Errorf("column %s: %w", rule.Name, err)
+		}
+	}
+	for i, rule := range config.Highlights {
+		if strings.TrimSpace(rule.Column) == "" {
+			return fmt.Errorf("highlight[%d]: column is required", i)
+		}
+		switch strings.ToLower(strings.TrimSpace(rule.Op)) {
+		case "gt", "lt":
+			if _, err := strconv.ParseFloat(strings.TrimSpace(rule.Value), 64); err != nil {
+				return fmt.Errorf("highlight[%d]: %s needs a numeric value: %s", i, rule.Op, rule.Value)
+			}
+		case "eq", "contains":
+		default:
+			return fmt.Errorf("highlight[%d]: op must be gt, lt, eq or contains", i)
+		}
+		if cssValue(rule.Color) == "" {
+			return fmt.Errorf("highlight[%d]: color is required", i)
+		}
+	}
+	if path := strings.TrimSpace(config.BodyTemplateFile); path != "" {
+		if _, _, err := parseBodyTemplate(path); err != nil {
+			return err
+		}
+	}
+	subjects := []string{config.SMTP.Subject, config.SMTP.SubjectEmpty}
+	for _, job := range config.Jobs {
+		subjects = append(subjects, job.Subject)
+	}
+	for _, subject := range subjects {
+		tmpl, err := parseSubject(subject)
+		if err != nil {
+			return fmt.Errorf("smtp.subject template parse failed: %w", err)
+		}
+		// Catches unknown fields such as {{.Rows}} before anything runs.
+		if err := tmpl.Execute(io.Discard, subjectData{}); err != nil {
+			return fmt.Errorf("smtp.subject template invalid: %w", err)
+		}
+	}
+	if message := strings.TrimSpace(config.CountMessage); message != "" {
+		tmpl, err := template.New("count_message").Parse(message)
+		if err != nil {
+			return fmt.Errorf("count_message parse failed: %w", err)
+		}
+		if err := tmpl.Execute(io.Discard, subjectData{}); err != nil {
+			return fmt.Errorf("count_message invalid: %w", err)
+		}
+	}
+	if config.MaxCellWidth < 0 {
+		return errors.New("max_cell_width must not be negative")
+	}
+	if config.NullString != "" && config.CSVNullAsEmpty {
+		return errors.New("null_string and csv_null_as_empty cannot be combined")
+	}
+	if decimals := config.NumberFormat.Decimals; decimals != nil && (*decimals < 0 || *decimals > 20) {
+		return errors.New("number_format.decimals must be between 0 and 20")
+	}
+	if config.NumberFormat.Thousands != "" && config.NumberFormat.Thousands == config.NumberFormat.Decimal {
+		return errors.New("number_format.thousands and number_format.decimal must differ")
+	}
+	if layout := newFormatOptions(config).DatetimeFormat; (time.Time{}).Format(layout) == layout {
+		return fmt.Errorf("datetime_format has no layout elements: %s", config.DatetimeFormat)
+	}
+	backends, err := normalizeNotify(config.Notify)
+	if err != nil {
+		return err
+	}
+	if path := strings.TrimSpace(config.SMTP.PassFile); path != "" {
+		if _, err := readSecretFile(path); err != nil {
+			return fmt.Errorf("smtp.pass_file: %w", err)
+		}
+	}
+	if path := strings.TrimSpace(config.SMTP.OAuthTokenFile); path != "" {
+		if _, err := readSecretFile(path); err != nil {
+			return fmt.Errorf("smtp.oauth_token_file: %w", err)
+		}
+	}
+	for _, db := range append([]DBConfig{config.DB}, sourceConfigs(config)...) {
+		if db.Retries < 0 || db.RetryDelay < 0 {
+			return errors.New("db.retries and db.retry_delay must not be negative")
+		}
+		if strings.TrimSpace(db.DSN) == "" && strings.TrimSpace(db.DSNTemplate) == "" {
+			if _, err := applyProvider(db); err != nil {
+				return err
+			}
+		}
+		if path := strings.TrimSpace(db.PassFile); path != "" {
+			if _, err := readSecretFile(path); err != nil {
+				return fmt.Errorf("db.pass_file: %w", err)
+			}
+		}
+		if path := strings.TrimSpace(db.TLSCAFile); path != "" {
+			if _, err := loadCAFile(path); err != nil {
+				return fmt.Errorf("db.tls_ca_file: %w", err)
+			}
+			switch strings.ToLower(strings.TrimSpace(db.SSLMode)) {
+			case "disable", "false":
+				return errors.New("db.tls_ca_file cannot be combined with ssl_mode = disable")
+			}
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(config.NotifyOn)) {
+	case "", "always", "rows", "empty":
+	default:
+		return fmt.Errorf("unsupported notify_on: %s (use always, rows or empty)", config.NotifyOn)
+	}
+	if config.MaxRowsFetched < 0 {
+		return errors.New("max_rows_fetched must not be negative")
+	}
+	if options.Preview < 0 {
+		return errors.New("-n must not be negative")
+	}
+	if config.MinRows < 0 || config.MaxRows < 0 {
+		return errors.New("min_rows and max_rows must not be negative")
+	}
+	if config.MaxRows > 0 && config.MaxRows < config.MinRows {
+		return errors.New("max_rows must not be less than min_rows")
+	}
+	if !mailTest && !dbTest {
+		if options.RenderFrom == "" {
+			if strings.TrimSpace(stripSQLComments(config.SQL, usesBackslashEscapes(config.DB.Type))) == "" {
+				return errors.New("sql query is required (use -sql or config sql)")
+			}
+			if len(config.Sources) > 0 {
+				labels := map[string]bool{}
+				for i, source := range config.Sources {
+					label := strings.TrimSpace(source.Label)
+					if label == "" {
+						return fmt.Errorf("source[%d].label is required", i)
+					}
+					if labels[label] {
+						return fmt.Errorf("duplicate source label: %s", label)
+					}
+					labels[label] = true
+					if strings.TrimSpace(sourceDB(config.DB, source).Type) == "" {
+						return fmt.Errorf("source %s: db.type is required", label)
+					}
+				}
+			} else if strings.TrimSpace(config.DB.Type) == "" {
+				return errors.New("db.type is required")
+			}
+			if strings.TrimSpace(config.CountQuery) != "" && config.InlineMaxRows <= 0 && !options.CountOnly {
+				return errors.New("inline_max_rows is required when count_query is set")
+			}
+			if config.FetchAllPages {
+				if strings.TrimSpace(config.PageTokenColumn) == "" {
+					return errors.New("page_token_column is required when fetch_all_pages is set")
+				}
+				if !strings.Contains(pageTokenQuery(config.SQL, usesBackslashEscapes(config.DB.Type)), ":page_token") {
+					return errors.New("sql must contain :page_token when fetch_all_pages is set")
+				}
+			}
+			if config.AllResultSets && (len(config.Sources) > 0 || config.FetchAllPages) {
+				return errors.New("all_result_sets cannot be combined with [[source]] or fetch_all_pages")
+			}
+		}
+		for _, backend := range backends {
+			if options.CountOnly && backend != "email" {
+				return fmt.Errorf("-count-only only sends email; remove %s from notify or run without -count-only", backend)
+			}
+			switch backend {
+			case "email":
+				if (options.RenderFrom != "" || strings.TrimSpace(config.OutputFile) != "") && !config.SMTP.mailEnabled() {
+					continue
+				}
+				if err := validateSMTP(config.SMTP); err != nil {
+					return err
+				}
+			case "nats":
+				if strings.TrimSpace(config.NATS.Subject) == "" {
+					return errors.New("nats.subject is required")
+				}
+			case "webhook":
+				if strings.TrimSpace(config.Webhook.URL) == "" {
+					return errors.New("webhook.url is required")
+				}
+				switch strings.ToUpper(strings.TrimSpace(config.Webhook.Method)) {
+				case "", "POST", "PUT", "PATCH":
+				default:
+					return fmt.Errorf("unsupported webhook.method: %s (use POST, PUT or PATCH)", config.Webhook.Method)
+				}
+			case "opsgenie":
+				if strings.TrimSpace(config.Opsgenie.APIKey) == "" {
+					return errors.New("opsgenie.api_key is required")
+				}
+				switch strings.ToUpper(strings.TrimSpace(config.Opsgenie.Priority)) {
+				case "", "P1", "P2", "P3", "P4", "P5":
+				default:
+					return fmt.Errorf("unsupported opsgenie.priority: %s", config.Opsgenie.Priority)
+				}
+			case "github":
+				if strings.TrimSpace(config.GitHub.Token) == "" {
+					return errors.New("github.token is required")
+				}
+				if parts := strings.Split(strings.TrimSpace(config.GitHub.Repo), "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+					return errors.New("github.repo must be owner/name")
+				}
+			case "slack":
+				if strings.TrimSpace(config.Slack.WebhookURL) == "" {
+					return errors.New("slack.webhook_url is required")
+				}
+			}
+		}
+		return nil
+	}
+	if dbTest {
+		if strings.TrimSpace(config.DB.Type) == "" {
+			return errors.New("db.type is required")
+		}
+	}
+	if mailTest {
+		if err := validateSMTP(config.SMTP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDSNs builds every DSN a run would use without opening a
+// connection, for -validate.
+func validateDSNs(config Config) error {
+	if len(config.Jobs) > 0 {
+		for _, job := range config.Jobs {
+			if err := validateDSNs(jobConfig(config, job)); err != nil {
+				return fmt.Errorf("job %s: %w", job.Name, err)
+			}
+		}
+		return nil
+	}
+	if len(config.Sources) > 0 {
+		for i, source := range sourceConfigs(config) {
+			if _, _, err := buildDSN(source); err != nil {
+				return fmt.Errorf("source %s: %w", config.Sources[i].Label, err)
+			}
+		}
+		return nil
+	}
+	_, _, err := buildDSN(config.DB)
+	return err
+}
+
+func validateSMTP(config SMTPConfig) error {
+	switch config.backend() {
+	case "smtp":
+	case "ses":
+		return validateEnvelope(config)
+	default:
+		return fmt.Errorf("smtp.backend must be smtp or ses: %s", config.Backend)
+	}
+	if strings.TrimSpace(config.Host) == "" {
+		return errors.New("smtp.host is required")
+	}
+	if path := strings.TrimSpace(config.TLSCAFile); path != "" {
+		if _, err := loadCAFile(path); err != nil {
+			return fmt.Errorf("smtp.tls_ca_file: %w", err)
+		}
+	}
+	if pin := normalizeFingerprint(config.TLSPin); pin != "" {
+		if !config.TLS {
+			return errors.New("smtp.tls_pin requires smtp.tls = true")
+		}
+		if decoded, err := hex.DecodeString(pin); err != nil || len(decoded) != sha256.Size {
+			return errors.New("smtp.tls_pin must be a SHA-256 fingerprint (64 hex characters)")
+		}
+	}
+	if config.Port == 0 {
+		return errors.New("smtp.port is required")
+	}
+	if err := validateEnvelope(config); err != nil {
+		return err
+	}
+	if strings.ContainsAny(strings.TrimSpace(config.Helo), " \t\r\n") {
+		return errors.New("smtp.helo must be a single hostname")
+	}
+	switch config.authType() {
+	case "plain", "login", "cram-md5", "auto":
+	case "xoauth2":
+		if strings.TrimSpace(config.User) == "" {
+			return errors.New("smtp.user is required for xoauth2")
+		}
+		if strings.TrimSpace(config.OAuthToken) == "" && strings.TrimSpace(config.OAuthTokenFile) == "" {
+			return errors.New("smtp.oauth_token or smtp.oauth_token_file is required for xoauth2")
+		}
+	default:
+		return fmt.Errorf("smtp.auth_type must be plain, login, cram-md5, xoauth2 or auto: %s", config.AuthType)
+	}
+	return nil
+}
+
+// validateEnvelope checks the settings shared by every smtp.backend.
+func validateEnvelope(config SMTPConfig) error {
+	if strings.TrimSpace(config.From) == "" {
+		return errors.New("smtp.from is required")
+	}
+	if len(config.To) == 0 && strings.TrimSpace(config.RecipientsQuery) == "" {
+		return errors.New("smtp.to or smtp.recipients_query is required")
+	}
+	if config.Retries < 0 || config.RetryDelay < 0 {
+		return errors.New("smtp.retries and smtp.retry_delay must not be negative")
+	}
+	if config.Timeout < 0 {
+		return errors.New("smtp.timeout must not be negative")
+	}
+	return validateHeaders(config)
+}
+
+func (config SMTPConfig) backend() string {
+	backend := strings.ToLower(strings.TrimSpace(config.Backend))
+	if backend == "" {
+		return "smtp"
+	}
+	return backend
+}
+
+// mailEnabled reports whether mail goes out at all; without smtp.host the
+// SMTP backend prints or only writes output_file instead.
+func (config SMTPConfig) mailEnabled() bool {
+	return config.backend() != "smtp" || strings.TrimSpace(config.Host) != ""
+}
+
+// addr is host:port for dialing, with IPv6 literals in brackets.
+func (config SMTPConfig) addr() string {
+	return net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+}
+
+func (config SMTPConfig) authType() string {
+	authType := strings.ToLower(strings.TrimSpace(config.AuthType))
+	if authType == "" {
+		return "plain"
+	}
+	return authType
+}
+
+// notifyOnAllows applies the run-wide notify_on setting; the per-backend
+// NotifyRule is checked after it.
+func notifyOnAllows(notifyOn string, rowCount int) bool {
+	switch strings.ToLower(strings.TrimSpace(notifyOn)) {
+	case "rows":
+		return rowCount > 0
+	case "empty":
+		return rowCount == 0
+	default:
+		return true
+	}
+}
+
+func normalizeNotify(values []string) ([]string, error) {
+	if len(values) == 0 {
+		return []string{"email"}, nil
+	}
+	var backends []string
+	seen := map[string]bool{}
+	for _, value := range values {
+		backend := strings.ToLower(strings.TrimSpace(value))
+		switch backend {
+		case "email", "nats", "webhook", "opsgenie", "github", "slack":
+		default:
+			return nil, fmt.Errorf("unsupported notify backend: %s", value)
+		}
+		if !seen[backend] {
+			seen[backend] = true
+			backends = append(backends, backend)
+		}
+	}
+	return backends, nil
+}
+
+func testDB(config DBConfig, debug bool) error {
+	dsn, driver, err := buildDSN(config)
+	if err != nil {
+		return err
+	}
+	debugf(debug, "db test: open driver=%s dsn=%s", driver, redactDSN(dsn))
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return fmt.Errorf("db open failed: %w", err)
+	}
+	defer db.Close()
+	configurePool(db, config)
+	debugf(debug, "db test: ping")
+	ctx, cancel := dbContext(config)
+	defer cancel()
+	conn, err := connectDB(ctx, db, config)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("db ping timed out after %ds", config.Timeout)
+		}
+		return redactError(fmt.Errorf("db ping failed: %w", err), config)
+	}
+	return conn.Close()
+}
+
+// connectDB takes a connection from the pool and pings it, retrying
+// connection-level failures db.retries times with a doubling db.retry_delay.
+// Only connecting is retried, never a statement, so a retry cannot repeat
+// side effects.
+func connectDB(ctx context.Context, db *sql.DB, config DBConfig) (*sql.Conn, error) {
+	delay := time.Duration(config.RetryDelay) * time.Second
+	if delay <= 0 {
+		delay = 5 * time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		conn, err := db.Conn(ctx)
+		if err == nil {
+			if err = conn.PingContext(ctx); err == nil {
+				return conn, nil
+			}
+			_ = conn.Close()
+		}
+		if attempt > config.Retries || ctx.Err() != nil || !dbTransient(err) {
+			return nil, err
+		}
+		debugf(config.Debug, "db: connect attempt %d failed: %v; retrying in %s", attempt, redactError(err, config), delay)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func dbTransient(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+type QueryResult struct {
+	Columns []string
+	Types   []ColumnType
+	Rows    [][]string
+	Nulls   [][]bool
+	// Values holds the scanned driver values behind Rows, before any display
+	// formatting, with []byte as text. It is nil for -render-from input.
+	Values    [][]interface{}
+	Warnings  []string
+	Truncated bool
+	// PreviewOf is the full row count when -n cut the rows, otherwise 0.
+	PreviewOf int
+	// StreamedCSV is the finished csv attachment when the rows were written
+	// to it as they were read; Rows is then empty and StreamedRows counts them.
+	StreamedCSV  string
+	StreamedRows int
+	Elapsed      time.Duration
+	// ResultSets holds the sets after the first with all_result_sets.
+	ResultSets []QueryResult
+}
+
+// ColumnType is the driver's description of a result column, for the
+// json_schema section. Either name may be empty when the driver does not
+// report it.
+type ColumnType struct {
+	DatabaseType string `json:"database_type"`
+	ScanType     string `json:"scan_type"`
+}
+
+// runQuery stops reading after limit rows (0 = no limit), cancels the rest of
+// the query, and marks the result as truncated.
+func runQuery(config DBConfig, query string, format formatOptions, limit int, params queryParams) (QueryResult, error) {
+	ctx, cancel := dbContext(config)
+	defer cancel()
+	result, err := queryContext(ctx, config, query, format, limit, params)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return result, fmt.Errorf("query timed out after %ds", config.Timeout)
+	}
+	return result, redactError(err, config)
+}
+
+const redacted = "xxxxx"
+
+var (
+	mysqlDSNPassword   = regexp.MustCompile(`^([^:@/]*):(.*)@([a-z0-9]*\(|/)`)
+	keywordDSNPassword = regexp.MustCompile(`(?i)\b(password|pwd)=('[^']*'|[^\s;&]*)`)
+)
+
+// redactDSN hides the password in any of the DSN shapes buildDSN produces
+// (URL userinfo, MySQL user:pass@, and password= keywords) so it can be logged.
+func redactDSN(dsn string) string {
+	if parsed, err := url.Parse(dsn); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		if _, ok := parsed.User.Password(); ok {
+			parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+		}
+		dsn = strings.Replace(parsed.String(), url.QueryEscape(redacted), redacted, 1)
+	} else {
+		dsn = mysqlDSNPassword.ReplaceAllString(dsn, "${1}:"+redacted+"@${3}")
+	}
+	return keywordDSNPassword.ReplaceAllString(dsn, "${1}="+redacted)
+}
+
+// redactError strips the db password from driver errors, some of which
+// quote the connection string they failed to parse. The password is taken
+// from pass, pass_file and the DSN actually used, so dsn and dsn_template
+// are covered too. The original error stays reachable through Unwrap.
+func redactError(err error, config DBConfig) error {
+	if err == nil {
+		return err
+	}
+	message := err.Error()
+	secrets := []string{config.Pass}
+	if dsn, _, dsnErr := buildDSN(config); dsnErr == nil {
+		message = strings.ReplaceAll(message, dsn, redactDSN(dsn))
+		secrets = append(secrets, dsnPassword(dsn))
+	}
+	if strings.TrimSpace(config.PassFile) != "" {
+		if pass, fileErr := readSecretFile(config.PassFile); fileErr == nil {
+			secrets = append(secrets, pass)
+		}
+	}
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		for _, form := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret)} {
+			message = strings.ReplaceAll(message, form, redacted)
+		}
+	}
+	if message == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, message: message}
+}
+
+// dsnPassword finds the password in the DSN shapes redactDSN knows.
+func dsnPassword(dsn string) string {
+	if parsed, err := url.Parse(dsn); err == nil && parsed.Scheme != "" && parsed.Host != "" {
+		pass, _ := parsed.User.Password()
+		return pass
+	}
+	if match := mysqlDSNPassword.FindStringSubmatch(dsn); match != nil {
+		return match[2]
+	}
+	if match := keywordDSNPassword.FindStringSubmatch(dsn); match != nil {
+		return strings.Trim(match[2], "'")
+	}
+	return ""
+}
+
+// redactedError keeps errors.Is and errors.As working on a redacted error.
+type redactedError struct {
+	err     error
+	message string
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// configurePool applies the db pool settings; zero values keep the
+// database/sql defaults.
+func configurePool(db *sql.DB, config DBConfig) {
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Duration(config.ConnMaxLifetime) * time.Second)
+	}
+}
+
+// dbContext applies db.timeout; 0 means wait as long as the database does.
+func dbContext(config DBConfig) (context.Context, context.CancelFunc) {
+	if config.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(config.Timeout)*time.Second)
+}
+
+func queryContext(ctx context.Context, config DBConfig, query string, format formatOptions, limit int, params queryParams) (QueryResult, error) {
+	conn, driver, err := openConn(ctx, config)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	setup, query := splitScript(query, usesBackslashEscapes(driver))
+	defer conn.Close()
+	if err := runSetup(ctx, conn, driver, append(append([]string{}, config.Setup...), setup...), params); err != nil {
+		return QueryResult{}, err
+	}
+	return queryConn(ctx, conn, driver, config, query, format, limit, params)
+}
+
+// dbPools keeps one *sql.DB per database for the life of the process, so
+// jobs, sources, pages and schedule ticks against the same database share a
+// pool and the pool settings take effect.
+var dbPools = struct {
+	sync.Mutex
+	pools map[string]*sql.DB
+}{pools: map[string]*sql.DB{}}
+
+// sharedDB returns the pool for driver and dsn, opening it on first use.
+// Configs that differ in their pool settings get separate pools.
+func sharedDB(driver, dsn string, config DBConfig) (*sql.DB, error) {
+	key := fmt.Sprintf("%s\x00%s\x00%d/%d/%d", driver, dsn, config.MaxOpenConns, config.MaxIdleConns, config.ConnMaxLifetime)
+	dbPools.Lock()
+	defer dbPools.Unlock()
+	if db, ok := dbPools.pools[key]; ok {
+		return db, nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(db, config)
+	dbPools.pools[key] = db
+	return db, nil
+}
+
+// openConn checks out one connection from the database's shared pool, so
+// setup statements and the queries after them share a session. Closing the
+// connection returns it to the pool.
+func openConn(ctx context.Context, config DBConfig) (*sql.Conn, string, error) {
+	dsn, driver, err := buildDSN(config)
+	if err != nil {
+		return nil, "", err
+	}
+	db, err := sharedDB(driver, dsn, config)
+	if err != nil {
+		return nil, "", fmt.Errorf("db open failed: %w", err)
+	}
+	conn, err := connectDB(ctx, db, config)
+	if err != nil {
+		return nil, "", fmt.Errorf("db connect failed: %w", err)
+	}
+	return conn, driver, nil
+}
+
+// runSetup executes setup statements so SET and temp tables carry over to
+// the queries on the same connection.
+func runSetup(ctx context.Context, conn *sql.Conn, driver string, setup []string, params queryParams) error {
+	for i, statement := range setup {
+		statement, setupArgs, err := bindNamedParams(statement, driver, queryParams{Named: params.Named})
+		if err != nil {
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, statement, setupArgs...); err != nil {
+			return fmt.Errorf("statement %d failed: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func queryConn(ctx context.Context, conn *sql.Conn, driver string, config DBConfig, query string, format formatOptions, limit int, params queryParams) (QueryResult, error) {
+	var result QueryResult
+	query, args, err := bindNamedParams(query, driver, params)
+	if err != nil {
+		return result, err
+	}
+
+	queryCtx, cancelQuery := context.WithCancel(ctx)
+	defer cancelQuery()
+	started := time.Now()
+	rows, err := conn.QueryContext(queryCtx, query, args...)
+	if err != nil {
+		return result, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+	result, err = readRows(rows, format, limit, cancelQuery)
+	if err != nil {
+		return result, err
+	}
+	for config.AllResultSets && !result.Truncated && rows.NextResultSet() {
+		next, err := readRows(rows, format, limit, cancelQuery)
+		if err != nil {
+			return result, err
+		}
+		result.ResultSets = append(result.ResultSets, next)
+		result.Truncated = next.Truncated
+	}
+	result.Elapsed = time.Since(started)
+	if result.Truncated {
+		// The cancelled query leaves the session unusable for SHOW WARNINGS.
+		return result, nil
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("row iterate failed: %w", err)
+	}
+	_ = rows.Close()
+	if config.CollectWarnings && driver == "mysql" {
+		warnings, err := collectWarnings(ctx, conn)
+		if err != nil {
+			return result, err
+		}
+		result.Warnings = warnings
+	}
+	return result, nil
+}
+
+// readRows reads the current result set, cancelling the query once limit
+// rows have been read.
+func readRows(rows *sql.Rows, format formatOptions, limit int, cancel context.CancelFunc) (QueryResult, error) {
+	var result QueryResult
+	columns, err := rows.Columns()
+	if err != nil {
+		return result, fmt.Errorf("columns read failed: %w", err)
+	}
+	result.Columns = columns
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return result, fmt.Errorf("column types read failed: %w", err)
+	}
+	for _, columnType := range types {
+		var scanType string
+		if columnType.ScanType() != nil {
+			scanType = columnType.ScanType().String()
+		}
+		result.Types = append(result.Types, ColumnType{DatabaseType: columnType.DatabaseTypeName(), ScanType: scanType})
+	}
+	if format.Sink != nil {
+		if err := format.Sink.writeHeader(columns); err != nil {
+			return result, err
+		}
+	}
+	for rows.Next() {
+		if limit > 0 && len(result.Rows)+result.StreamedRows == limit {
+			result.Truncated = true
+			cancel()
+			break
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return result, fmt.Errorf("row scan failed: %w", err)
+		}
+		row := make([]string, len(columns))
+		nulls := make([]bool, len(columns))
+		for i, value := range values {
+			row[i] = formatValue(value, format)
+			if bytes, ok := value.([]byte); ok {
+				values[i] = string(bytes)
+			}
+			if format.Number.appliesTo(columns[i]) && numericValue(value, result.Types[i].DatabaseType) {
+				row[i] = formatNumber(plainNumber(value, row[i]), format.Number)
+			}
+			nulls[i] = value == nil
+		}
+		if format.Sink != nil {
+			if err := format.Sink.writeRow(row, nulls); err != nil {
+				return result, err
+			}
+			result.StreamedRows++
+			continue
+		}
+		result.Rows = append(result.Rows, row)
+		result.Nulls = append(result.Nulls, nulls)
+		result.Values = append(result.Values, values)
+	}
+	return result, nil
+}
+
+// collectWarnings must run on the same connection as the query, since MySQL
+// keeps warnings per session.
+func collectWarnings(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, "SHOW WARNINGS")
+	if err != nil {
+		return nil, fmt.Errorf("show warnings failed: %w", err)
+	}
+	defer rows.Close()
+	var warnings []string
+	for rows.Next() {
+		var level, code, message string
+		if err := rows.Scan(&level, &code, &message); err != nil {
+			return nil, fmt.Errorf("show warnings scan failed: %w", err)
+		}
+		warnings = append(warnings, fmt.Sprintf("%s %s: %s", level, code, message))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("show warnings failed: %w", err)
+	}
+	return warnings, nil
+}
+
+func loadRenderInput(path string) (QueryResult, error) {
+	var result QueryResult
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return result, fmt.Errorf("render input read failed: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return parseJSONResult(content)
+	}
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(content, []byte(utf8BOM))))
+	records, err := reader.ReadAll()
+	if err != nil {
+		return result, fmt.Errorf("render input parse failed: %w", err)
+	}
+	if len(records) == 0 {
+		return result, errors.New("render input has no header row")
+	}
+	result.Columns = records[0]
+	for _, record := range records[1:] {
+		result.Rows = append(result.Rows, record)
+		result.Nulls = append(result.Nulls, make([]bool, len(record)))
+	}
+	return result, nil
+}
+
+// parseJSONResult reads an array of objects (the json output shape), keeping
+// the key order of the first object as the column order.
+func parseJSONResult(content []byte) (QueryResult, error) {
+	var result QueryResult
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return result, errors.New("render input parse failed: expected a JSON array of objects")
+	}
+	index := map[string]int{}
+	var objects []map[string]json.RawMessage
+	for decoder.More() {
+		if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+			return result, errors.New("render input parse failed: expected a JSON array of objects")
+		}
+		object := map[string]json.RawMessage{}
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return result, fmt.Errorf("render input parse failed: %w", err)
+			}
+			key, _ := token.(string)
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return result, fmt.Errorf("render input parse failed: %w", err)
+			}
+			if _, ok := index[key]; !ok {
+				index[key] = len(result.Columns)
+				result.Columns = append(result.Columns, key)
+			}
+			object[key] = value
+		}
+		if _, err := decoder.Token(); err != nil {
+			return result, fmt.Errorf("render input parse failed: %w", err)
+		}
+		objects = append(objects, object)
+	}
+	for _, object := range objects {
+		row := make([]string, len(result.Columns))
+		nulls := make([]bool, len(result.Columns))
+		for i, column := range result.Columns {
+			raw, ok := object[column]
+			if !ok || string(raw) == "null" {
+				nulls[i] = true
+				continue
+			}
+			var text string
+			if err := json.Unmarshal(raw, &text); err == nil {
+				row[i] = text
+			} else {
+				row[i] = string(raw)
+			}
+		}
+		result.Rows = append(result.Rows, row)
+		result.Nulls = append(result.Nulls, nulls)
+	}
+	return result, nil
+}
+
+func runSourcesQuery(config Config, params queryParams, debug bool) (QueryResult, error) {
+	labelColumn := strings.TrimSpace(config.SourceLabelColumn)
+	if labelColumn == "" {
+		labelColumn = "source"
+	}
+	var combined QueryResult
+	for i, source := range config.Sources {
+		limit := 0
+		if config.MaxRowsFetched > 0 {
+			if limit = config.MaxRowsFetched - len(combined.Rows); limit <= 0 {
+				combined.Truncated = true
+				debugf(debug, "source %s: skipped, max_rows_fetched reached", source.Label)
+				break
+			}
+		}
+		debugf(debug, "source %s: query", source.Label)
+		result, err := runQuery(sourceDB(config.DB, source), config.SQL, newFormatOptions(config), limit, params)
+		if err != nil {
+			return combined, fmt.Errorf("source %s: %w", source.Label, err)
+		}
+		columns := append([]string{labelColumn}, result.Columns...)
+		if i == 0 {
+			combined.Columns = columns
+			combined.Types = append([]ColumnType{{ScanType: "string"}}, result.Types...)
+		} else if strings.Join(columns, "\x00") != strings.Join(combined.Columns, "\x00") {
+			return combined, fmt.Errorf("source %s returned columns [%s], expected [%s]", source.Label,
+				strings.Join(result.Columns, ", "), strings.Join(combined.Columns[1:], ", "))
+		}
+		for r, row := range result.Rows {
+			combined.Rows = append(combined.Rows, append([]string{source.Label}, row...))
+			combined.Nulls = append(combined.Nulls, append([]bool{false}, result.Nulls[r]...))
+			combined.Values = append(combined.Values, append([]interface{}{source.Label}, result.Values[r]...))
+		}
+		for _, warning := range result.Warnings {
+			combined.Warnings = append(combined.Warnings, source.Label+": "+warning)
+		}
+		combined.Truncated = combined.Truncated || result.Truncated
+		combined.Elapsed += result.Elapsed
+	}
+	return combined, nil
+}
+
+// sourceConfigs resolves every [[source]] entry against [db].
+func sourceConfigs(config Config) []DBConfig {
+	configs := make([]DBConfig, len(config.Sources))
+	for i, source := range config.Sources {
+		configs[i] = sourceDB(config.DB, source)
+	}
+	return configs
+}
+
+// sourceDB fills the unset fields of a [[source]] entry from [db].
+func sourceDB(base DBConfig, source SourceConfig) DBConfig {
+	merged := base
+	override := source.DBConfig
+	merged.Type = overrideString(merged.Type, override.Type)
+	merged.Provider = overrideString(merged.Provider, override.Provider)
+	merged.Host = overrideString(merged.Host, override.Host)
+	if override.Port != 0 {
+		merged.Port = override.Port
+	}
+	if override.Timeout != 0 {
+		merged.Timeout = override.Timeout
+	}
+	if override.MaxOpenConns != 0 {
+		merged.MaxOpenConns = override.MaxOpenConns
+	}
+	if override.MaxIdleConns != 0 {
+		merged.MaxIdleConns = override.MaxIdleConns
+	}
+	if override.ConnMaxLifetime != 0 {
+		merged.ConnMaxLifetime = override.ConnMaxLifetime
+	}
+	if override.Retries != 0 {
+		merged.Retries = override.Retries
+	}
+	if override.RetryDelay != 0 {
+		merged.RetryDelay = override.RetryDelay
+	}
+	merged.User = overrideString(merged.User, override.User)
+	merged.Pass = overrideString(merged.Pass, override.Pass)
+	merged.PassFile = overrideString(merged.PassFile, override.PassFile)
+	if strings.TrimSpace(override.Pass) != "" && strings.TrimSpace(override.PassFile) == "" {
+		// An inline pass on the source wins over the inherited pass_file.
+		merged.PassFile = ""
+	}
+	if len(override.Options) > 0 {
+		merged.Options = override.Options
+	}
+	merged.Name = overrideString(merged.Name, override.Name)
+	merged.SSLMode = overrideString(merged.SSLMode, override.SSLMode)
+	merged.TLSCAFile = overrideString(merged.TLSCAFile, override.TLSCAFile)
+	merged.DSN = override.DSN
+	merged.DSNTemplate = overrideString(merged.DSNTemplate, override.DSNTemplate)
+	merged.CollectWarnings = merged.CollectWarnings || override.CollectWarnings
+	merged.SimpleProtocol = merged.SimpleProtocol || override.SimpleProtocol
+	return merged
+}
+
+// pageTokenQuery rewrites the older {page_token} placeholder to the bound
+// :page_token parameter.
+func pageTokenQuery(query string, backslashEscapes bool) string {
+	var builder strings.Builder
+	for _, segment := range tokenizeSQL(query, backslashEscapes) {
+		if segment.Kind == sqlCode {
+			segment.Text = strings.ReplaceAll(segment.Text, "{page_token}", ":page_token")
+		}
+		builder.WriteString(segment.Text)
+	}
+	return builder.String()
+}
+
+// runPagedQuery follows a continuation token column: the last row's token is
+// bound as :page_token (NULL for the first page) until no token comes back.
+// All pages run on one connection, after the setup statements, and db.timeout
+// covers the whole fetch.
+func runPagedQuery(config Config, params queryParams, debug bool) (QueryResult, error) {
+	ctx, cancel := dbContext(config.DB)
+	defer cancel()
+	result, err := pagedQuery(ctx, config, params, debug)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return result, fmt.Errorf("query timed out after %ds", config.DB.Timeout)
+	}
+	return result, redactError(err, config.DB)
+}
+
+func pagedQuery(ctx context.Context, config Config, params queryParams, debug bool) (QueryResult, error) {
+	var combined QueryResult
+	conn, driver, err := openConn(ctx, config.DB)
+	if err != nil {
+		return combined, err
+	}
+	setup, query := splitScript(config.SQL, usesBackslashEscapes(driver))
+	defer conn.Close()
+	if err := runSetup(ctx, conn, driver, append(append([]string{}, config.DB.Setup...), setup...), params); err != nil {
+		return combined, err
+	}
+	query = pageTokenQuery(query, usesBackslashEscapes(driver))
+	named := map[string]interface{}{}
+	for name, value := range params.Named {
+		named[name] = value
+	}
+	pageParams := queryParams{Named: named, Positional: params.Positional}
+	token := ""
+	seen := map[string]bool{}
+	for page := 1; ; page++ {
+		named["page_token"] = nil
+		if page > 1 {
+			named["page_token"] = token
+		}
+		limit := 0
+		if config.MaxRowsFetched > 0 {
+			if limit = config.MaxRowsFetched - len(combined.Rows); limit <= 0 {
+				combined.Truncated = true
+				break
+			}
+		}
+		debugf(debug, "paging: page=%d token=%q", page, token)
+		result, err := queryConn(ctx, conn, driver, config.DB, query, newFormatOptions(config), limit, pageParams)
+		if err != nil {
+			return combined, fmt.Errorf("page %d: %w", page, err)
+		}
+		tokenIndex := -1
+		for i, column := range result.Columns {
+			if column == config.PageTokenColumn {
+				tokenIndex = i
+			}
+		}
+		if tokenIndex < 0 {
+			return combined, fmt.Errorf("page_token_column %s not found in result", config.PageTokenColumn)
+		}
+		columns := removeIndex(result.Columns, tokenIndex)
+		if page == 1 {
+			combined.Columns = columns
+			if len(result.Types) == len(result.Columns) {
+				combined.Types = removeIndex(result.Types, tokenIndex)
+			}
+		} else if strings.Join(columns, "\x00") != strings.Join(combined.Columns, "\x00") {
+			return combined, fmt.Errorf("page %d returned different columns", page)
+		}
+		for i, row := range result.Rows {
+			combined.Rows = append(combined.Rows, removeIndex(row, tokenIndex))
+			combined.Nulls = append(combined.Nulls, removeIndex(result.Nulls[i], tokenIndex))
+			combined.Values = append(combined.Values, removeIndex(result.Values[i], tokenIndex))
+		}
+		combined.Warnings = append(combined.Warnings, result.Warnings...)
+		combined.Elapsed += result.Elapsed
+		if result.Truncated {
+			combined.Truncated = true
+			break
+		}
+		if len(result.Rows) == 0 {
+			break
+		}
+		last := len(result.Rows) - 1
+		token = result.Rows[last][tokenIndex]
+		if result.Nulls[last][tokenIndex] || strings.TrimSpace(token) == "" {
+			break
+		}
+		if seen[token] {
+			return combined, fmt.Errorf("page %d repeated continuation token %q", page, token)
+		}
+		seen[token] = true
+	}
+	return combined, nil
+}
+
+func removeIndex[T any](values []T, index int) []T {
+	trimmed := make([]T, 0, len(values))
+	trimmed = append(trimmed, values[:index]...)
+	return append(trimmed, values[index+1:]...)
+}
+
+// queryParams holds the values bound to a query: positional ones from params
+// or -param, and named ones (:from, :to) numbered after them.
+type queryParams struct {
+	Named      map[string]interface{}
+	Positional []interface{}
+}
+
+func queryParameters(config Config, now time.Time) (queryParams, error) {
+	named, err := namedParams(config, now)
+	if err != nil {
+		return queryParams{}, err
+	}
+	return queryParams{Named: named, Positional: config.Params}, nil
+}
+
+// paramNumber matches the plain decimal numbers parseParamValue types as
+// numbers. Leading zeros, signs other than "-", exponents, hex, underscores
+// and nan/inf keep a value a string, so codes like "00123" survive.
+var paramNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+// parseParamValue types a -param value: plain decimal integers and floats
+// and true/false become numbers and booleans, anything else stays a string.
+func parseParamValue(value string) interface{} {
+	if paramNumber.MatchString(value) {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parsed
+		}
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	switch strings.ToLower(value) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return value
+}
+
+func namedParams(config Config, now time.Time) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+	var from, to time.Time
+	var err error
+	if strings.TrimSpace(config.From) != "" {
+		if from, err = parseWindowTime(config.From, now); err != nil {
+			return nil, fmt.Errorf("invalid from: %w", err)
+		}
+		params["from"] = from
+	}
+	if strings.TrimSpace(config.To) != "" {
+		if to, err = parseWindowTime(config.To, now); err != nil {
+			return nil, fmt.Errorf("invalid to: %w", err)
+		}
+		params["to"] = to
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return nil, errors.New("to must not be before from")
+	}
+	return params, nil
+}
+
+// parseWindowTime accepts absolute dates/timestamps plus now, today,
+// yesterday and offsets like -7d or -12h relative to now (days from today).
+func parseWindowTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch strings.ToLower(value) {
+	case "now":
+		return now, nil
+	case "today":
+		return today, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		if strings.HasSuffix(value, "d") {
+			days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+			if err != nil {
+				return time.Time{}, fmt.Errorf("unrecognized offset: %s", value)
+			}
+			return today.AddDate(0, 0, days), nil
+		}
+		offset, err := time.ParseDuration(value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unrecognized offset: %s", value)
+		}
+		return now.Add(offset), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", time.DateOnly} {
+		if parsed, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date: %s", value)
+}
+
+// bindNamedParams rewrites :name references to the driver's positional
+// placeholder, skipping string literals, comments and Postgres :: casts.
+// Positional params come first, so named ones are numbered after them.
+func bindNamedParams(query string, driver string, params queryParams) (string, []interface{}, error) {
+	args := append([]interface{}{}, params.Positional...)
+	if len(params.Named) == 0 {
+		return query, args, nil
+	}
+	named := 0
+	bound := replaceNamedParams(query, params.Named, usesBackslashEscapes(driver), func(value interface{}) string {
+		args = append(args, value)
+		named++
+		return placeholder(driver, len(args))
+	})
+	if named > 0 && len(params.Positional) > 0 && placeholder(driver, 1) == "?" {
+		return "", nil, fmt.Errorf("positional params cannot be combined with :name parameters on %s", driver)
+	}
+	return bound, args, nil
+}
+
+// inlineNamedParams renders the query with each :name replaced by a quoted
+// literal. It is for display only; execution always binds parameters.
+func inlineNamedParams(query string, params map[string]interface{}, backslashEscapes bool, format formatOptions) string {
+	return replaceNamedParams(query, params, backslashEscapes, func(value interface{}) string {
+		return "'" + strings.ReplaceAll(formatValue(value, format), "'", "''") + "'"
+	})
+}
+
+func replaceNamedParams(query string, params map[string]interface{}, backslashEscapes bool, replace func(value interface{}) string) string {
+	var builder strings.Builder
+	for _, segment := range tokenizeSQL(query, backslashEscapes) {
+		if segment.Kind != sqlCode {
+			builder.WriteString(segment.Text)
+			continue
+		}
+		text := segment.Text
+		for i := 0; i < len(text); i++ {
+			if text[i] != ':' || (i > 0 && text[i-1] == ':') || (i+1 < len(text) && text[i+1] == ':') {
+				builder.WriteByte(text[i])
+				continue
+			}
+			end := i + 1
+			for end < len(text) && (text[end] == '_' || text[end] >= 'a' && text[end] <= 'z' || text[end] >= 'A' && text[end] <= 'Z' || text[end] >= '0' && text[end] <= '9') {
+				end++
+			}
+			value, ok := params[strings.ToLower(text[i+1:end])]
+			if end == i+1 || !ok {
+				builder.WriteByte(text[i])
+				continue
+			}
+			builder.WriteString(replace(value))
+			i = end - 1
+		}
+	}
+	return builder.String()
+}
+
+// renderDSNTemplate evaluates db.dsn_template against the resolved DB fields,
+// so flag and env overrides still apply to DSN shapes buildDSN doesn't know.
+func renderDSNTemplate(config DBConfig) (string, error) {
+	tmpl, err := template.New("dsn_template").Funcs(template.FuncMap{
+		"urlencode": func(value string) string {
+			return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+		},
+	}).Parse(config.DSNTemplate)
+	if err != nil {
+		return "", fmt.Errorf("db.dsn_template parse failed: %w", err)
+	}
+	if config.Port == 0 {
+		config.Port = defaultDBPort(config.Type)
+	}
+	var builder strings.Builder
+	if err := tmpl.Execute(&builder, config); err != nil {
+		return "", fmt.Errorf("db.dsn_template render failed: %w", err)
+	}
+	return builder.String(), nil
+}
+
+// readSecretFile reads a mounted secret (Docker/Kubernetes style); the
+// trailing newline most tools write is trimmed.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSQLFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("sql_file read failed: %w", err)
+	}
+	query := trimSQL(string(data))
+	if query == "" {
+		return "", fmt.Errorf("sql_file is empty: %s", path)
+	}
+	return query, nil
+}
+
+// readSQLStdin reads the query for -sql -. A terminal on stdin means nothing
+// was piped, and reading it would block until the user typed EOF.
+func readSQLStdin(stdin *os.File) (string, error) {
+	if info, err := stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return "", errors.New("-sql -: no query piped on stdin")
+	}
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return "", fmt.Errorf("stdin read failed: %w", err)
+	}
+	query := trimSQL(string(data))
+	if query == "" {
+		return "", errors.New("-sql -: stdin is empty")
+	}
+	return query, nil
+}
+
+func trimSQL(query string) string {
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+}
+
+// providerCABundle names the CA bundle that verifies each provider's MySQL
+// servers, for the error when tls_ca_file is missing.
+var providerCABundle = map[string]string{
+	"aws": "the RDS CA bundle (https://truststore.pki.rds.amazonaws.com/global/global-bundle.pem)",
+	"gcp": "the instance's server-ca.pem from Cloud SQL",
+}
+
+// applyProvider fills in what a managed database needs when db.provider is
+// set: TLS by default everywhere, and for Azure SQL encryption plus the
+// user@server login form. Explicit settings win except Azure encryption.
+func applyProvider(config DBConfig) (DBConfig, error) {
+	provider := strings.ToLower(strings.TrimSpace(config.Provider))
+	dbType := strings.ToLower(config.Type)
+	switch provider {
+	case "":
+		return config, nil
+	case "azure", "aws", "gcp":
+	default:
+		return config, fmt.Errorf("unsupported db.provider: %s (use azure, aws or gcp)", config.Provider)
+	}
+	if strings.TrimSpace(config.SSLMode) == "" {
+		switch dbType {
+		case "postgres", "postgresql", "pgx":
+			config.SSLMode = "require"
+		case "mysql", "mariadb":
+			config.SSLMode = "require"
+			// RDS and Cloud SQL certificates are not in the system pool, so
+			// verification needs the provider's CA bundle; skipping it has to
+			// be asked for with ssl_mode = "skip-verify".
+			if provider != "azure" && strings.TrimSpace(config.TLSCAFile) == "" {
+				return config, fmt.Errorf("db.tls_ca_file is required for mysql with provider %s: point it at %s, or set ssl_mode = \"skip-verify\" to connect without verifying the server", provider, providerCABundle[provider])
+			}
+		}
+	}
+	if provider == "azure" && (dbType == "mssql" || dbType == "sqlserver") {
+		if server, _, found := strings.Cut(config.Host, "."); found && !strings.Contains(config.User, "@") && strings.TrimSpace(config.User) != "" {
+			config.User += "@" + server
+		}
+	}
+	return config, nil
+}
+
+// mysqlTLS maps db.ssl_mode to the driver's tls parameter. A tls_ca_file is
+// registered as a named config that verifies against that CA.
+func mysqlTLS(config DBConfig) (string, error) {
+	name := ""
+	switch strings.ToLower(strings.TrimSpace(config.SSLMode)) {
+	case "", "disable", "false":
+	case "require", "true":
+		name = "true"
+	case "skip-verify", "preferred":
+		name = strings.ToLower(strings.TrimSpace(config.SSLMode))
+	default:
+		return "", fmt.Errorf("db.ssl_mode for mysql must be disable, require, skip-verify or preferred: %s", config.SSLMode)
+	}
+	path := strings.TrimSpace(config.TLSCAFile)
+	if path == "" || name == "skip-verify" || name == "preferred" {
+		return name, nil
+	}
+	if strings.TrimSpace(config.SSLMode) != "" && name == "" {
+		return "", errors.New("db.tls_ca_file cannot be combined with ssl_mode = disable")
+	}
+	pool, err := loadCAFile(path)
+	if err != nil {
+		return "", fmt.Errorf("db.tls_ca_file: %w", err)
+	}
+	sum := sha256.Sum256([]byte(path + "\x00" + config.Host))
+	name = "notifysql-" + hex.EncodeToString(sum[:8])
+	if err := mysql.RegisterTLSConfig(name, &tls.Config{RootCAs: pool, ServerName: config.Host}); err != nil {
+		return "", fmt.Errorf("db.tls_ca_file: %w", err)
+	}
+	return name, nil
+}
+
+func defaultDBPort(dbType string) int {
+	switch strings.ToLower(dbType) {
+	case "mysql", "mariadb":
+		return 3306
+	case "postgres", "postgresql", "pgx":
+		return 5432
+	case "mssql", "sqlserver":
+		return 1433
+	case "clickhouse":
+		return 9000
+	default:
+		return 0
+	}
+}
+
+func placeholder(driver string, position int) string {
+	switch driver {
+	case "pgx":
+		return "$" + strconv.Itoa(position)
+	case "sqlserver":
+		return "@p" + strconv.Itoa(position)
+	default:
+		return "?"
+	}
+}
+
+func buildDSN(config DBConfig) (string, string, error) {
+	if strings.TrimSpace(config.PassFile) != "" {
+		pass, err := readSecretFile(config.PassFile)
+		if err != nil {
+			return "", "", fmt.Errorf("db.pass_file: %w", err)
+		}
+		config.Pass = pass
+	}
+	if strings.TrimSpace(config.DSN) == "" && strings.TrimSpace(config.DSNTemplate) != "" {
+		dsn, err := renderDSNTemplate(config)
+		if err != nil {
+			return "", "", err
+		}
+		config.DSN = dsn
+	}
+	if strings.TrimSpace(config.DSN) != "" {
+		switch strings.ToLower(config.Type) {
+		case "mysql", "mariadb":
+			return config.DSN, "mysql", nil
+		case "postgres", "postgresql", "pgx":
+			return config.DSN, "pgx", nil
+		case "mssql", "sqlserver":
+			return config.DSN, "sqlserver", nil
+		case "clickhouse":
+			return config.DSN, "clickhouse", nil
+		case "sqlite", "sqlite3":
+			return config.DSN, "sqlite", nil
+		default:
+			return "", "", fmt.Errorf("unsupported db.type: %s", config.Type)
+		}
+	}
+
+	config, err := applyProvider(config)
+	if err != nil {
+		return "", "", err
+	}
+	switch strings.ToLower(config.Type) {
+	case "mysql", "mariadb":
+		port := config.Port
+		if port == 0 {
+			port = 3306
+		}
+		if strings.TrimSpace(config.Host) == "" {
+			return "", "", errors.New("db.host is required")
+		}
+		if strings.TrimSpace(config.User) == "" {
+			return "", "", errors.New("db.user is required")
+		}
+		if strings.TrimSpace(config.Name) == "" {
+			return "", "", errors.New("db.name is required")
+		}
+		// The driver splits user from password at the first colon, which no
+		// escaping can avoid; FormatDSN handles the rest of the password.
+		if strings.Contains(config.User, ":") {
+			return "", "", errors.New("db.user cannot contain ':' for mysql")
+		}
+		mysqlConfig := mysql.NewConfig()
+		mysqlConfig.User = config.User
+		mysqlConfig.Passwd = config.Pass
+		mysqlConfig.Net = "tcp"
+		mysqlConfig.Addr = net.JoinHostPort(config.Host, strconv.Itoa(port))
+		mysqlConfig.DBName = config.Name
+		mysqlConfig.ParseTime = true
+		tlsName, err := mysqlTLS(config)
+		if err != nil {
+			return "", "", err
+		}
+		mysqlConfig.TLSConfig = tlsName
+		// Options the driver keeps in Params (session variables, charset) are
+		// escaped by FormatDSN; its own settings (collation, multiStatements,
+		// ...) are appended after the generated ones so they win.
+		keys := make([]string, 0, len(config.Options))
+		for key := range config.Options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var driverOptions []string
+		for _, key := range keys {
+			value := url.QueryEscape(config.Options[key])
+			probe, err := mysql.ParseDSN("/?" + key + "=" + value)
+			if err != nil {
+				return "", "", fmt.Errorf("db.options.%s: %w", key, err)
+			}
+			if _, variable := probe.Params[key]; variable {
+				if mysqlConfig.Params == nil {
+					mysqlConfig.Params = map[string]string{}
+				}
+				mysqlConfig.Params[key] = config.Options[key]
+				continue
+			}
+			driverOptions = append(driverOptions, key+"="+value)
+		}
+		dsn := mysqlConfig.FormatDSN()
+		if len(driverOptions) > 0 {
+			separator := "?"
+			if strings.Contains(dsn, "?") {
+				separator = "&"
+			}
+			dsn += separator + strings.Join(driverOptions, "&")
 		}
-		dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", config.User, config.Pass, config.Host, port, config.Name)
 		return dsn, "mysql", nil
 	case "postgres", "postgresql", "pgx":
 		port := config.Port
 		if port == 0 {
 			port = 5432
 		}
-		if strings.TrimSpace(config.Host) == "" {
-			return "", "", errors.New("db.host is required")
+		if strings.TrimSpace(config.Host) == "" {
+			return "", "", errors.New("db.host is required")
+		}
+		if strings.TrimSpace(config.User) == "" {
+			return "", "", errors.New("db.user is required")
+		}
+		if strings.TrimSpace(config.Name) == "" {
+			return "", "", errors.New("db.name is required")
+		}
+		sslMode := config.SSLMode
+		if strings.TrimSpace(sslMode) == "" {
+			sslMode = "disable"
+		}
+		query := url.Values{}
+		query.Set("sslmode", sslMode)
+		// PgBouncer in transaction mode cannot keep server-side prepared
+		// statements; the simple protocol interpolates parameters instead.
+		if config.SimpleProtocol {
+			query.Set("default_query_exec_mode", "simple_protocol")
+		}
+		for key, value := range config.Options {
+			query.Set(key, value)
+		}
+		dsn := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(config.User, config.Pass),
+			Host:     net.JoinHostPort(config.Host, strconv.Itoa(port)),
+			Path:     "/" + config.Name,
+			RawQuery: query.Encode(),
+		}
+		return dsn.String(), "pgx", nil
+	case "mssql", "sqlserver":
+		port := config.Port
+		if port == 0 {
+			port = 1433
+		}
+		if strings.TrimSpace(config.Host) == "" {
+			return "", "", errors.New("db.host is required")
+		}
+		if strings.TrimSpace(config.User) == "" {
+			return "", "", errors.New("db.user is required")
+		}
+		if strings.TrimSpace(config.Name) == "" {
+			return "", "", errors.New("db.name is required")
+		}
+		query := url.Values{"database": {config.Name}}
+		if strings.EqualFold(config.Provider, "azure") {
+			query.Set("encrypt", "true")
+		}
+		dsn := url.URL{
+			Scheme:   "sqlserver",
+			User:     url.UserPassword(config.User, config.Pass),
+			Host:     net.JoinHostPort(config.Host, strconv.Itoa(port)),
+			RawQuery: query.Encode(),
+		}
+		return dsn.String(), "sqlserver", nil
+	case "clickhouse":
+		port := config.Port
+		if port == 0 {
+			port = 9000
+		}
+		if strings.TrimSpace(config.Host) == "" {
+			return "", "", errors.New("db.host is required")
+		}
+		if strings.TrimSpace(config.User) == "" {
+			return "", "", errors.New("db.user is required")
+		}
+		if strings.TrimSpace(config.Name) == "" {
+			return "", "", errors.New("db.name is required")
+		}
+		sslMode := "false"
+		if strings.EqualFold(strings.TrimSpace(config.SSLMode), "require") {
+			sslMode = "true"
+		}
+		dsn := url.URL{
+			Scheme:   "clickhouse",
+			User:     url.UserPassword(config.User, config.Pass),
+			Host:     net.JoinHostPort(config.Host, strconv.Itoa(port)),
+			Path:     "/" + config.Name,
+			RawQuery: url.Values{"secure": {sslMode}}.Encode(),
+		}
+		return dsn.String(), "clickhouse", nil
+	case "sqlite", "sqlite3":
+		if strings.TrimSpace(config.Name) == "" {
+			return "", "", errors.New("db.name is required (path to the sqlite file)")
+		}
+		return config.Name, "sqlite", nil
+	default:
+		return "", "", fmt.Errorf("unsupported db.type: %s", config.Type)
+	}
+}
+
+type formatOptions struct {
+	DatetimeFormat string
+	Number         NumberFormat
+	// Sink, when set, receives each row instead of the result keeping it.
+	Sink rowSink
+}
+
+// rowSink takes rows as they are read, so a large result can be written out
+// without holding it in memory.
+type rowSink interface {
+	writeHeader(columns []string) error
+	writeRow(row []string, nulls []bool) error
+}
+
+// NumberFormat groups digits and fixes decimal places for numeric cells. It
+// applies to every numeric column unless columns is set, minus
+// exclude_columns, and only once thousands, decimal or decimals is set.
+type NumberFormat struct {
+	Thousands      string   `toml:"thousands"`
+	Decimal        string   `toml:"decimal"`
+	Decimals       *int     `toml:"decimals"`
+	Columns        []string `toml:"columns"`
+	ExcludeColumns []string `toml:"exclude_columns"`
+}
+
+func (format NumberFormat) enabled() bool {
+	return format.Thousands != "" || format.Decimals != nil || (format.Decimal != "" && format.Decimal != ".")
+}
+
+func (format NumberFormat) appliesTo(column string) bool {
+	if !format.enabled() || containsFold(format.ExcludeColumns, column) {
+		return false
+	}
+	return len(format.Columns) == 0 || containsFold(format.Columns, column)
+}
+
+// Leading zeros are left alone so zip codes and padded codes survive.
+var plainNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?$`)
+
+// plainNumber undoes the exponent notation fmt uses for large and small
+// floats so they can be grouped.
+func plainNumber(value interface{}, formatted string) string {
+	switch typed := value.(type) {
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(typed), 'f', -1, 32)
+	}
+	return formatted
+}
+
+// Column types whose values drivers hand back as text, such as MySQL and SQL
+// Server DECIMAL, matched after dropping any "(precision, scale)".
+var numericDatabaseTypes = map[string]bool{
+	"DECIMAL": true, "NUMERIC": true, "MONEY": true, "SMALLMONEY": true,
+	"TINYINT": true, "SMALLINT": true, "MEDIUMINT": true, "INT": true, "INTEGER": true, "BIGINT": true,
+	"UNSIGNED TINYINT": true, "UNSIGNED SMALLINT": true, "UNSIGNED MEDIUMINT": true, "UNSIGNED INT": true, "UNSIGNED BIGINT": true,
+	"INT2": true, "INT4": true, "INT8": true, "FLOAT4": true, "FLOAT8": true,
+	"FLOAT": true, "DOUBLE": true, "REAL": true,
+}
+
+// numericValue reports whether number_format may touch a value: only ints,
+// floats and decimals qualify, so a text column of digits (an order number,
+// a phone number) keeps its exact spelling.
+func numericValue(value interface{}, databaseType string) bool {
+	switch value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, *big.Int, *big.Rat, *big.Float:
+		return true
+	case []byte, string:
+		name, _, _ := strings.Cut(strings.ToUpper(strings.TrimSpace(databaseType)), "(")
+		return numericDatabaseTypes[strings.TrimSpace(name)]
+	}
+	return false
+}
+
+func formatNumber(value string, format NumberFormat) string {
+	if !plainNumberPattern.MatchString(value) {
+		return value
+	}
+	if format.Decimals != nil {
+		if rat, ok := new(big.Rat).SetString(value); ok {
+			value = rat.FloatString(*format.Decimals)
+		}
+	}
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+	whole, fraction, hasFraction := strings.Cut(value, ".")
+	var builder strings.Builder
+	if negative && strings.Trim(whole+fraction, "0") != "" {
+		builder.WriteString("-")
+	}
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			builder.WriteString(format.Thousands)
+		}
+		builder.WriteRune(digit)
+	}
+	if hasFraction {
+		decimal := format.Decimal
+		if decimal == "" {
+			decimal = "."
+		}
+		builder.WriteString(decimal + fraction)
+	}
+	return builder.String()
+}
+
+var datetimeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"datetime":    time.DateTime,
+	"date":        time.DateOnly,
+	"time":        time.TimeOnly,
+	"rfc1123":     time.RFC1123,
+	"kitchen":     time.Kitchen,
+}
+
+func newFormatOptions(config Config) formatOptions {
+	layout := strings.TrimSpace(config.DatetimeFormat)
+	if named, ok := datetimeLayouts[strings.ToLower(layout)]; ok {
+		layout = named
+	}
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	number := config.NumberFormat
+	for _, rule := range config.ColumnRules {
+		if strings.TrimSpace(rule.Format) != "" {
+			// A [[column]] format gets the raw value, not a grouped one.
+			number.ExcludeColumns = append(append([]string{}, number.ExcludeColumns...), rule.Name)
+		}
+	}
+	return formatOptions{DatetimeFormat: layout, Number: number}
+}
+
+func formatValue(value interface{}, format formatOptions) string {
+	if value == nil || isNilValue(reflect.ValueOf(value)) {
+		return ""
+	}
+	switch typed := value.(type) {
+	case []byte:
+		return string(typed)
+	case string:
+		return typed
+	case time.Time:
+		if format.DatetimeFormat != "" {
+			return typed.Format(format.DatetimeFormat)
+		}
+		return typed.String()
+	case fmt.Stringer:
+		// net.IP and uuid.UUID are byte slices and arrays underneath.
+		return typed.String()
+	case driver.Valuer:
+		if inner, err := typed.Value(); err == nil {
+			return formatValue(inner, format)
+		}
+	}
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Pointer:
+		if reflected.IsNil() {
+			return ""
+		}
+		return formatValue(reflected.Elem().Interface(), format)
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return formatNested(reflected, format)
+	}
+	return fmt.Sprint(value)
+}
+
+func isNilValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
+
+// formatNested renders ClickHouse Array/Map/Tuple values (Go slices, maps and
+// []interface{}) as [1, 2, 3] and {k: v} instead of fmt's [1 2 3] and map[k:v].
+func formatNested(value reflect.Value, format formatOptions) string {
+	if value.IsValid() && value.CanInterface() && !isNilValue(value) {
+		switch value.Interface().(type) {
+		case time.Time, fmt.Stringer, driver.Valuer:
+			return formatValue(value.Interface(), format)
+		}
+	}
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return "null"
+		}
+		return formatNested(value.Elem(), format)
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return "[]"
+		}
+		if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+			return string(value.Bytes())
+		}
+		parts := make([]string, value.Len())
+		for i := range parts {
+			parts[i] = formatNested(value.Index(i), format)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case reflect.Map:
+		type entry struct {
+			key   string
+			value string
+		}
+		entries := make([]entry, 0, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			entries = append(entries, entry{key: formatNested(iter.Key(), format), value: formatNested(iter.Value(), format)})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		parts := make([]string, len(entries))
+		for i, item := range entries {
+			parts[i] = item.key + ": " + item.value
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case reflect.String:
+		return value.String()
+	}
+	if !value.CanInterface() {
+		return fmt.Sprint(value)
+	}
+	return formatValue(value.Interface(), format)
+}
+
+type sqlSegmentKind int
+
+const (
+	sqlCode sqlSegmentKind = iota
+	sqlQuoted
+	sqlComment
+)
+
+type sqlSegment struct {
+	Kind sqlSegmentKind
+	Text string
+}
+
+// tokenizeSQL splits a script into code, quoted and comment segments so that
+// statement analysis never looks inside string literals or comments.
+// Backslash escapes apply inside quotes only with backslashEscapes (MySQL and
+// MariaDB) and in PostgreSQL E'...' strings; elsewhere 'C:\' is a complete
+// literal.
+func tokenizeSQL(query string, backslashEscapes bool) []sqlSegment {
+	var segments []sqlSegment
+	start := 0
+	emit := func(kind sqlSegmentKind, end int) {
+		if end > start {
+			segments = append(segments, sqlSegment{Kind: kind, Text: query[start:end]})
+		}
+		start = end
+	}
+	for i := 0; i < len(query); {
+		switch {
+		case strings.HasPrefix(query[i:], "--"):
+			emit(sqlCode, i)
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			i += end
+			emit(sqlComment, i)
+		case strings.HasPrefix(query[i:], "/*"):
+			emit(sqlCode, i)
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			emit(sqlComment, i)
+		case query[i] == '\'' || query[i] == '"' || query[i] == '`':
+			escapes := backslashEscapes && query[i] != '`' || query[i] == '\'' && escapeStringPrefix(query, i)
+			emit(sqlCode, i)
+			i = skipSQLQuoted(query, i, query[i], escapes)
+			emit(sqlQuoted, i)
+		case query[i] == '$':
+			tag := dollarQuoteTag(query[i:])
+			if tag == "" {
+				i++
+				continue
+			}
+			emit(sqlCode, i)
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+			emit(sqlQuoted, i)
+		default:
+			i++
+		}
+	}
+	emit(sqlCode, len(query))
+	return segments
+}
+
+func skipSQLQuoted(query string, i int, quote byte, escapes bool) int {
+	for i++; i < len(query); i++ {
+		if query[i] == '\\' && escapes {
+			i++
+			continue
+		}
+		if query[i] != quote {
+			continue
+		}
+		if i+1 < len(query) && query[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(query)
+}
+
+// escapeStringPrefix reports whether the quote at i opens a PostgreSQL
+// E'...' string, where backslash escapes apply.
+func escapeStringPrefix(query string, i int) bool {
+	if i == 0 || query[i-1] != 'E' && query[i-1] != 'e' {
+		return false
+	}
+	return i == 1 || !isIdentByte(query[i-2])
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || b == '$' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b >= 0x80
+}
+
+// usesBackslashEscapes reports whether a db.type or driver name treats
+// backslash as an escape inside string literals by default.
+func usesBackslashEscapes(name string) bool {
+	switch strings.ToLower(name) {
+	case "mysql", "mariadb":
+		return true
+	}
+	return false
+}
+
+func dollarQuoteTag(value string) string {
+	end := strings.IndexByte(value[1:], '$')
+	if end < 0 {
+		return ""
+	}
+	tag := value[:end+2]
+	for _, r := range tag[1 : len(tag)-1] {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return ""
+		}
+	}
+	if len(tag) > 2 && tag[1] >= '0' && tag[1] <= '9' {
+		return ""
+	}
+	return tag
+}
+
+func stripSQLComments(query string, backslashEscapes bool) string {
+	var builder strings.Builder
+	for _, segment := range tokenizeSQL(query, backslashEscapes) {
+		if segment.Kind == sqlComment {
+			builder.WriteString(" ")
+			continue
+		}
+		builder.WriteString(segment.Text)
+	}
+	return builder.String()
+}
+
+var queryMarkerPattern = regexp.MustCompile(`(?m)^[ \t]*--[ \t]*@query[ \t]*$`)
+
+// splitScript separates setup statements from the final, result-producing
+// one at a "-- @query" line. Without the marker the script is sent as one
+// batch, so T-SQL variables and BEGIN ... END bodies stay intact.
+func splitScript(script string, backslashEscapes bool) ([]string, string) {
+	loc := queryMarkerPattern.FindStringIndex(script)
+	if loc == nil {
+		return nil, script
+	}
+	query := strings.TrimSpace(script[loc[1]:])
+	return splitSQLStatements(script[:loc[0]], backslashEscapes), strings.TrimSpace(strings.TrimSuffix(query, ";"))
+}
+
+func splitSQLStatements(query string, backslashEscapes bool) []string {
+	var statements []string
+	var current strings.Builder
+	flush := func() {
+		statement := strings.TrimSpace(current.String())
+		if strings.TrimSpace(stripSQLComments(statement, backslashEscapes)) != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+	for _, segment := range tokenizeSQL(query, backslashEscapes) {
+		if segment.Kind != sqlCode {
+			current.WriteString(segment.Text)
+			continue
+		}
+		parts := strings.Split(segment.Text, ";")
+		for i, part := range parts {
+			if i > 0 {
+				flush()
+			}
+			current.WriteString(part)
+		}
+	}
+	flush()
+	return statements
+}
+
+// ColumnRule is a [[column]] entry. Format is either a printf pattern
+// ("%.2f", "%d ms") or a datetime layout; align applies to table and
+// markdown output.
+type ColumnRule struct {
+	Name   string `toml:"name"`
+	Format string `toml:"format"`
+	Align  string `toml:"align"`
+}
+
+func validateColumnFormat(format string) error {
+	if strings.TrimSpace(format) == "" {
+		return nil
+	}
+	if strings.Contains(format, "%") {
+		if printfVerb(format) == 0 || strings.Count(strings.ReplaceAll(format, "%%", ""), "%") != 1 {
+			return fmt.Errorf("format must contain exactly one printf directive: %s", format)
+		}
+		return nil
+	}
+	layout := format
+	if named, ok := datetimeLayouts[strings.ToLower(strings.TrimSpace(format))]; ok {
+		layout = named
+	}
+	if (time.Time{}).Format(layout) == layout {
+		return fmt.Errorf("format is neither a printf pattern nor a datetime layout: %s", format)
+	}
+	return nil
+}
+
+func columnRule(config Config, column string) (ColumnRule, bool) {
+	for _, rule := range config.ColumnRules {
+		if strings.EqualFold(strings.TrimSpace(rule.Name), column) {
+			return rule, true
+		}
+	}
+	return ColumnRule{}, false
+}
+
+func columnAligns(config Config, columns []string) []string {
+	aligns := make([]string, len(columns))
+	for i, column := range columns {
+		if rule, ok := columnRule(config, column); ok {
+			aligns[i] = strings.ToLower(strings.TrimSpace(rule.Align))
+		}
+	}
+	return aligns
+}
+
+func applyColumnRules(config Config, data QueryResult) {
+	layout := newFormatOptions(config).DatetimeFormat
+	for i, column := range data.Columns {
+		rule, ok := columnRule(config, column)
+		if !ok || strings.TrimSpace(rule.Format) == "" {
+			continue
+		}
+		for r, row := range data.Rows {
+			if r < len(data.Nulls) && data.Nulls[r][i] {
+				continue
+			}
+			row[i] = formatColumnValue(rule.Format, layout, row[i])
+		}
+	}
+}
+
+// formatColumnValue leaves values the format can't take (non-numbers for %f,
+// non-timestamps for a layout) unchanged.
+func formatColumnValue(format, datetimeLayout, value string) string {
+	if !strings.Contains(format, "%") {
+		parsed, err := time.Parse(datetimeLayout, value)
+		if err != nil {
+			return value
+		}
+		if named, ok := datetimeLayouts[strings.ToLower(strings.TrimSpace(format))]; ok {
+			format = named
+		}
+		return parsed.Format(format)
+	}
+	trimmed := strings.TrimSpace(value)
+	switch printfVerb(format) {
+	case 'd', 'x', 'X', 'o', 'b', 'c':
+		if number, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+			return fmt.Sprintf(format, number)
+		}
+		if number, err := strconv.ParseFloat(trimmed, 64); err == nil {
+			return fmt.Sprintf(format, int64(math.Round(number)))
+		}
+		return value
+	case 'f', 'F', 'e', 'E', 'g', 'G':
+		if number, err := strconv.ParseFloat(trimmed, 64); err == nil {
+			return fmt.Sprintf(format, number)
+		}
+		return value
+	}
+	return fmt.Sprintf(format, value)
+}
+
+// printfVerb returns the verb of the first directive in format, skipping
+// "%%" and flags, width and precision.
+func printfVerb(format string) rune {
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			continue
+		}
+		for ; i < len(format); i++ {
+			if strings.IndexByte("+-# 0123456789.", format[i]) < 0 {
+				return rune(format[i])
+			}
+		}
+	}
+	return 0
+}
+
+func humanizeResult(units map[string]string, data QueryResult) {
+	if len(units) == 0 {
+		return
+	}
+	for i, column := range data.Columns {
+		unit := ""
+		for name, value := range units {
+			if strings.EqualFold(name, column) {
+				unit = strings.ToLower(strings.TrimSpace(value))
+			}
+		}
+		if unit == "" {
+			continue
+		}
+		for r, row := range data.Rows {
+			if r < len(data.Nulls) && data.Nulls[r][i] {
+				continue
+			}
+			number, err := strconv.ParseFloat(strings.TrimSpace(row[i]), 64)
+			if err != nil {
+				continue
+			}
+			row[i] = humanize(unit, number)
+		}
+	}
+}
+
+func humanize(unit string, value float64) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	switch unit {
+	case "duration":
+		switch {
+		case value < 60:
+			return sign + trimDecimal(value) + "s"
+		case value < 3600:
+			return sign + trimDecimal(value/60) + "m"
+		case value < 86400:
+			return sign + trimDecimal(value/3600) + "h"
+		default:
+			return sign + trimDecimal(value/86400) + "d"
+		}
+	case "bytes":
+		units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+		index := 0
+		for value >= 1024 && index < len(units)-1 {
+			value /= 1024
+			index++
+		}
+		return sign + trimDecimal(value) + " " + units[index]
+	case "count":
+		units := []string{"", "K", "M", "B", "T"}
+		index := 0
+		for value >= 1000 && index < len(units)-1 {
+			value /= 1000
+			index++
+		}
+		return sign + trimDecimal(value) + units[index]
+	}
+	return sign + trimDecimal(value)
+}
+
+func trimDecimal(value float64) string {
+	return strings.TrimSuffix(strconv.FormatFloat(value, 'f', 1, 64), ".0")
+}
+
+// reportQuery is what show_query puts in the body: the configured SQL and,
+// for parameterized runs, the resolved values and the query with them inlined.
+type reportQuery struct {
+	SQL       string
+	Params    []string
+	Effective string
+}
+
+func newReportQuery(config Config, params queryParams) reportQuery {
+	query := reportQuery{SQL: config.SQL}
+	if len(params.Named) == 0 && len(params.Positional) == 0 {
+		return query
+	}
+	format := newFormatOptions(config)
+	for i, value := range params.Positional {
+		query.Params = append(query.Params, fmt.Sprintf("#%d = %s", i+1, formatValue(value, format)))
+	}
+	names := make([]string, 0, len(params.Named))
+	for name := range params.Named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		query.Params = append(query.Params, fmt.Sprintf(":%s = %s", name, formatValue(params.Named[name], format)))
+	}
+	query.Effective = inlineNamedParams(config.SQL, params.Named, usesBackslashEscapes(config.DB.Type), format)
+	return query
+}
+
+func buildMailBody(query reportQuery, result string, format string, contentType string, showQuery bool) string {
+	label := strings.ToUpper(format)
+	if strings.TrimSpace(label) == "" {
+		label = "CSV"
+	}
+	if strings.EqualFold(strings.TrimSpace(format), "html") {
+		section := ""
+		if showQuery {
+			section = htmlQuerySection(query)
+		}
+		return strings.Replace(result, htmlQueryMarker, section, 1)
+	}
+	if strings.HasPrefix(contentType, "text/html") {
+		return buildHTMLBody(query, result, label, showQuery)
+	}
+	if showQuery && len(query.Params) > 0 {
+		return fmt.Sprintf("SQL Query:\n%s\n\nParameters:\n%s\n\nEffective Query:\n%s\n\nResult (%s):\n%s", query.SQL, strings.Join(query.Params, "\n"), query.Effective, label, result)
+	}
+	if showQuery {
+		return fmt.Sprintf("SQL Query:\n%s\n\nResult (%s):\n%s", query.SQL, label, result)
+	}
+	return fmt.Sprintf("Result (%s):\n%s", label, result)
+}
+
+// sendMail retries transient failures (network errors, 4xx replies) up to
+// smtp.retries times, doubling smtp.retry_delay between attempts. 5xx
+// rejects are returned right away.
+func sendMail(config SMTPConfig, body string, contentType string, attachments []*Attachment, debug bool) error {
+	if config.DryRun {
+		return printDryRun(config, body, contentType, attachments)
+	}
+	delay := time.Duration(config.RetryDelay) * time.Second
+	if delay <= 0 {
+		delay = 5 * time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		err := sendMailOnce(config, body, contentType, attachments, debug)
+		if err == nil || attempt > config.Retries || !smtpTransient(err) {
+			return err
+		}
+		debugf(debug, "smtp: attempt %d failed: %v; retrying in %s", attempt, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func smtpTransient(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func sendMailOnce(config SMTPConfig, body string, contentType string, attachments []*Attachment, debug bool) error {
+	if config.backend() == "ses" {
+		recipients := config.SMTPRecipients()
+		if len(recipients) == 0 {
+			return errors.New("no recipients specified")
+		}
+		return sendSES(config, recipients, buildMessage(config, body, contentType, attachments), debug)
+	}
+	if debug && !config.ReuseConnection {
+		return sendMailDebug(config, body, contentType, attachments, debug)
+	}
+	addr := config.addr()
+	debugf(debug, "smtp: server=%s", addr)
+	message := buildMessage(config, body, contentType, attachments)
+
+	recipients := append([]string{}, config.SMTPRecipients()...)
+	if len(recipients) == 0 {
+		return errors.New("no recipients specified")
+	}
+	debugf(debug, "smtp: recipients=%d", len(recipients))
+
+	if config.ReuseConnection {
+		return sharedSMTP.send(config, recipients, message, debug)
+	}
+
+	client, err := dialSMTP(config, debug)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := smtpTransaction(client, config.From, recipients, message, debug); err != nil {
+		return err
+	}
+	debugf(debug, "smtp: quit")
+	return client.Quit()
+}
+
+// printDryRun writes the envelope and the message buildMessage would send,
+// with attachment contents replaced by a size note.
+func printDryRun(config SMTPConfig, body string, contentType string, attachments []*Attachment) error {
+	recipients := config.SMTPRecipients()
+	if len(recipients) == 0 {
+		return errors.New("no recipients specified")
+	}
+	server := "smtp=" + config.addr()
+	if config.backend() == "ses" {
+		server = "backend=ses"
+	}
+	fmt.Printf("dry-run: %s from=%s recipients=%s\n\n", server, config.From, strings.Join(recipients, ", "))
+	_, err := os.Stdout.Write(buildMessage(config, body, contentType, attachments))
+	fmt.Println()
+	return err
+}
+
+func dialSMTP(config SMTPConfig, debug bool) (*smtp.Client, error) {
+	addr := config.addr()
+	debugf(debug, "smtp: dialing %s", addr)
+	conn, err := dialSMTPConn(config, addr)
+	if err != nil {
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("smtp dial failed: %w", err)
+	}
+	// Without smtp.helo the client keeps net/smtp's default, "localhost".
+	if helo := strings.TrimSpace(config.Helo); helo != "" {
+		debugf(debug, "smtp: ehlo %s", helo)
+		if err := client.Hello(helo); err != nil {
+			_ = client.Close()
+			return nil, fmt.Errorf("smtp ehlo failed: %w", err)
+		}
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		debugf(debug, "smtp: starttls")
+		tlsConfig, err := smtpTLSConfig(config)
+		if err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			_ = client.Close()
+			return nil, fmt.Errorf("starttls failed: %w", err)
+		}
+	} else if config.TLS {
+		_ = client.Close()
+		return nil, errors.New("smtp server does not support STARTTLS")
+	}
+	if err := smtpAuth(config, client, debug); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// dialSMTPConn connects to the mail server. With smtp.timeout set, the
+// connect and every later read or write (including the STARTTLS handshake)
+// must finish within that many seconds.
+func dialSMTPConn(config SMTPConfig, addr string) (net.Conn, error) {
+	if config.Timeout <= 0 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("smtp dial failed: %w", err)
+		}
+		return conn, nil
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("smtp dial failed: %w", err)
+	}
+	return &deadlineConn{Conn: conn, timeout: timeout}, nil
+}
+
+// deadlineConn renews the deadline before each read and write, so an idle or
+// stuck server times out while a slow but progressing upload does not.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func smtpTransaction(client *smtp.Client, from string, recipients []string, message []byte, debug bool) error {
+	debugf(debug, "smtp: mail from=%s", from)
+	if err := client.Mail(from); err != nil {
+		return fmt.Errorf("smtp from failed: %w", err)
+	}
+	for _, recipient := range recipients {
+		debugf(debug, "smtp: rcpt=%s", recipient)
+		if err := client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("smtp rcpt failed: %w", err)
+		}
+	}
+	debugf(debug, "smtp: sending data")
+	writer, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp data failed: %w", err)
+	}
+	if _, err := writer.Write(message); err != nil {
+		return fmt.Errorf("smtp write failed: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("smtp close failed: %w", err)
+	}
+	return nil
+}
+
+// smtpSession keeps one SMTP connection open for every message of a run when
+// reuse_connection is set. Sends are serialized because jobs may run
+// concurrently.
+type smtpSession struct {
+	mu     sync.Mutex
+	key    string
+	client *smtp.Client
+}
+
+var sharedSMTP = &smtpSession{}
+
+func (s *smtpSession) send(config SMTPConfig, recipients []string, message []byte, debug bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := fmt.Sprintf("%s:%d/%s/%t", config.Host, config.Port, config.User, config.TLS)
+	if s.client != nil && s.key != key {
+		s.quit(debug)
+	}
+	reused := s.client != nil
+	if reused {
+		// RSET between messages also detects a connection the server dropped.
+		debugf(debug, "smtp: rset")
+		if err := s.client.Reset(); err != nil {
+			debugf(debug, "smtp: reused connection is gone, redialing: %v", err)
+			_ = s.client.Close()
+			s.client = nil
+			reused = false
 		}
-		if strings.TrimSpace(config.User) == "" {
-			return "", "", errors.New("db.user is required")
+	}
+	if !reused {
+		client, err := dialSMTP(config, debug)
+		if err != nil {
+			return err
 		}
-		if strings.TrimSpace(config.Name) == "" {
-			return "", "", errors.New("db.name is required")
+		s.client = client
+		s.key = key
+	} else {
+		debugf(debug, "smtp: reusing connection")
+	}
+	if err := smtpTransaction(s.client, config.From, recipients, message, debug); err != nil {
+		debugf(debug, "smtp: rset")
+		if resetErr := s.client.Reset(); resetErr != nil {
+			_ = s.client.Close()
+			s.client = nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *smtpSession) close(debug bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		s.quit(debug)
+	}
+}
+
+func (s *smtpSession) quit(debug bool) {
+	debugf(debug, "smtp: quit")
+	if err := s.client.Quit(); err != nil {
+		_ = s.client.Close()
+	}
+	s.client = nil
+}
+
+func sendMailDebug(config SMTPConfig, body string, contentType string, attachments []*Attachment, debug bool) error {
+	addr := config.addr()
+	message := buildMessage(config, body, contentType, attachments)
+	recipients := append([]string{}, config.SMTPRecipients()...)
+	if len(recipients) == 0 {
+		return errors.New("no recipients specified")
+	}
+
+	debugf(debug, "smtp: dial %s", addr)
+	conn, err := dialSMTPConn(config, addr)
+	if err != nil {
+		return err
+	}
+	text := textproto.NewConn(conn)
+	defer func() {
+		_ = text.Close()
+		_ = conn.Close()
+	}()
+
+	if err := expectSMTPResponse(text, debug, []int{220}); err != nil {
+		return err
+	}
+
+	hostname := smtpHostname(config)
+	capabilities, err := smtpEhlo(text, debug, hostname)
+	if err != nil {
+		return err
+	}
+
+	if config.TLS {
+		if !capabilities["STARTTLS"] {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		debugf(debug, "C: STARTTLS")
+		if _, err := smtpCmdExpect(text, debug, "STARTTLS", []int{220}); err != nil {
+			return err
+		}
+		tlsConfig, err := smtpTLSConfig(config)
+		if err != nil {
+			return err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("starttls handshake failed: %w", err)
+		}
+		text = textproto.NewConn(tlsConn)
+		conn = tlsConn
+		capabilities, err = smtpEhlo(text, debug, hostname)
+		if err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(config.User) != "" {
+		if err := smtpDebugAuth(text, config, capabilities, debug); err != nil {
+			return err
+		}
+	}
+
+	debugf(debug, "C: MAIL FROM:<%s>", config.From)
+	if _, err := smtpCmdExpect(text, debug, "MAIL FROM:<"+config.From+">", []int{250}); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		debugf(debug, "C: RCPT TO:<%s>", recipient)
+		if _, err := smtpCmdExpect(text, debug, "RCPT TO:<"+recipient+">", []int{250, 251}); err != nil {
+			return err
+		}
+	}
+	debugf(debug, "C: DATA")
+	if _, err := smtpCmdExpect(text, debug, "DATA", []int{354}); err != nil {
+		return err
+	}
+	writer := text.DotWriter()
+	if _, err := writer.Write(message); err != nil {
+		return fmt.Errorf("smtp write failed: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("smtp close failed: %w", err)
+	}
+	if err := expectSMTPResponse(text, debug, []int{250}); err != nil {
+		return err
+	}
+	debugf(debug, "C: QUIT")
+	if _, err := smtpCmdExpect(text, debug, "QUIT", []int{221}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func smtpTLSConfig(config SMTPConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: config.Host}
+	if path := strings.TrimSpace(config.TLSCAFile); path != "" {
+		pool, err := loadCAFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("smtp.tls_ca_file: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.TLSInsecureSkipVerify {
+		// Dev-only escape hatch for self-signed servers; a tls_pin, if set,
+		// is still enforced by VerifyConnection below.
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if pin := normalizeFingerprint(config.TLSPin); pin != "" {
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("smtp tls pin: server sent no certificate")
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if got := hex.EncodeToString(sum[:]); got != pin {
+				return fmt.Errorf("smtp tls pin mismatch: server certificate sha256 is %s", got)
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+func loadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+func normalizeFingerprint(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	value = strings.ReplaceAll(value, ":", "")
+	return strings.ReplaceAll(value, " ", "")
+}
+
+func smtpEhlo(conn *textproto.Conn, debug bool, hostname string) (map[string]bool, error) {
+	debugf(debug, "C: EHLO %s", hostname)
+	msg, err := smtpCmdExpect(conn, debug, "EHLO "+hostname, []int{250})
+	if err != nil {
+		return nil, err
+	}
+	capabilities := map[string]bool{}
+	for _, line := range strings.Split(msg, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		keyword := strings.ToUpper(fields[0])
+		capabilities[keyword] = true
+		if keyword == "AUTH" {
+			for _, mechanism := range fields[1:] {
+				capabilities["AUTH "+strings.ToUpper(mechanism)] = true
+			}
+		}
+	}
+	return capabilities, nil
+}
+
+func smtpCmdExpect(conn *textproto.Conn, debug bool, cmd string, expected []int) (string, error) {
+	if err := conn.PrintfLine(cmd); err != nil {
+		return "", fmt.Errorf("smtp write failed: %w", err)
+	}
+	code, msg, err := readSMTPResponse(conn)
+	if err != nil {
+		return "", err
+	}
+	debugf(debug, "S: %d %s", code, msg)
+	for _, allowed := range expected {
+		if code == allowed {
+			return msg, nil
+		}
+	}
+	return "", fmt.Errorf("smtp unexpected response: %w", &textproto.Error{Code: code, Msg: msg})
+}
+
+func expectSMTPResponse(conn *textproto.Conn, debug bool, expected []int) error {
+	code, msg, err := readSMTPResponse(conn)
+	if err != nil {
+		return err
+	}
+	debugf(debug, "S: %d %s", code, msg)
+	for _, allowed := range expected {
+		if code == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("smtp unexpected response: %w", &textproto.Error{Code: code, Msg: msg})
+}
+
+func readSMTPResponse(conn *textproto.Conn) (int, string, error) {
+	line, err := conn.ReadLine()
+	if err != nil {
+		return 0, "", fmt.Errorf("smtp read failed: %w", err)
+	}
+	if len(line) < 3 {
+		return 0, "", fmt.Errorf("smtp invalid response: %s", line)
+	}
+	code, err := strconv.Atoi(line[:3])
+	if err != nil {
+		return 0, "", fmt.Errorf("smtp invalid response code: %s", line)
+	}
+	message := ""
+	if len(line) > 4 {
+		message = line[4:]
+	}
+	if len(line) > 3 && line[3] == '-' {
+		for {
+			more, err := conn.ReadLine()
+			if err != nil {
+				return 0, "", fmt.Errorf("smtp read failed: %w", err)
+			}
+			if len(more) > 4 {
+				message += "\n" + more[4:]
+			}
+			if strings.HasPrefix(more, fmt.Sprintf("%03d ", code)) {
+				break
+			}
+		}
+	}
+	return code, message, nil
+}
+
+func smtpHostname(config SMTPConfig) string {
+	if helo := strings.TrimSpace(config.Helo); helo != "" {
+		return helo
+	}
+	hostname, err := os.Hostname()
+	if err != nil || strings.TrimSpace(hostname) == "" {
+		return "localhost"
+	}
+	return hostname
+}
+
+func smtpAuth(config SMTPConfig, client *smtp.Client, debug bool) error {
+	if strings.TrimSpace(config.User) == "" {
+		return nil
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		return errors.New("smtp server does not support AUTH")
+	}
+	mechanism, err := smtpAuthMechanism(config, func(name string) bool {
+		return smtpSupportsAuth(client, name)
+	})
+	if err != nil {
+		return err
+	}
+	debugf(debug, "smtp: auth %s", mechanism)
+	var auth smtp.Auth
+	switch mechanism {
+	case "XOAUTH2":
+		auth = xoauth2Auth{user: config.User, token: config.OAuthToken}
+	case "LOGIN":
+		auth = loginAuth{user: config.User, pass: config.Pass, host: config.Host}
+	case "CRAM-MD5":
+		auth = smtp.CRAMMD5Auth(config.User, config.Pass)
+	default:
+		auth = smtp.PlainAuth("", config.User, config.Pass, config.Host)
+	}
+	if err := client.Auth(auth); err != nil {
+		return fmt.Errorf("smtp auth failed: %w", err)
+	}
+	return nil
+}
+
+func smtpSupportsAuth(client *smtp.Client, mechanism string) bool {
+	_, mechanisms := client.Extension("AUTH")
+	for _, supported := range strings.Fields(mechanisms) {
+		if strings.EqualFold(supported, mechanism) {
+			return true
 		}
-		sslMode := config.SSLMode
-		if strings.TrimSpace(sslMode) == "" {
-			sslMode = "disable"
+	}
+	return false
+}
+
+// smtpAuthMechanism resolves smtp.auth_type against the mechanisms the
+// server advertises. "auto" prefers XOAUTH2 when a token is configured, then
+// PLAIN, LOGIN and CRAM-MD5.
+func smtpAuthMechanism(config SMTPConfig, supported func(string) bool) (string, error) {
+	authType := config.authType()
+	if authType != "auto" {
+		mechanism := strings.ToUpper(authType)
+		if !supported(mechanism) {
+			return "", fmt.Errorf("smtp server does not support AUTH %s", mechanism)
 		}
-		dsn := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s", config.User, config.Pass, config.Host, port, config.Name, sslMode)
-		return dsn, "pgx", nil
-	case "mssql", "sqlserver":
-		port := config.Port
-		if port == 0 {
-			port = 1433
+		return mechanism, nil
+	}
+	candidates := []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+	if strings.TrimSpace(config.OAuthToken) != "" {
+		candidates = append([]string{"XOAUTH2"}, candidates...)
+	}
+	for _, mechanism := range candidates {
+		if supported(mechanism) {
+			return mechanism, nil
 		}
-		if strings.TrimSpace(config.Host) == "" {
-			return "", "", errors.New("db.host is required")
+	}
+	return "", errors.New("smtp server offers no supported AUTH mechanism")
+}
+
+// smtpDebugAuth is the hand-rolled counterpart of smtpAuth for the debug
+// transcript path.
+func smtpDebugAuth(text *textproto.Conn, config SMTPConfig, capabilities map[string]bool, debug bool) error {
+	if !capabilities["AUTH"] {
+		return errors.New("smtp server does not support AUTH")
+	}
+	mechanism, err := smtpAuthMechanism(config, func(name string) bool {
+		return capabilities["AUTH "+name]
+	})
+	if err != nil {
+		return err
+	}
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	debugf(debug, "C: AUTH %s (redacted)", mechanism)
+	switch mechanism {
+	case "XOAUTH2":
+		if err := text.PrintfLine("AUTH XOAUTH2 %s", encode(string(xoauth2Payload(config.User, config.OAuthToken)))); err != nil {
+			return fmt.Errorf("smtp write failed: %w", err)
 		}
-		if strings.TrimSpace(config.User) == "" {
-			return "", "", errors.New("db.user is required")
+		code, msg, err := readSMTPResponse(text)
+		if err != nil {
+			return err
 		}
-		if strings.TrimSpace(config.Name) == "" {
-			return "", "", errors.New("db.name is required")
+		debugf(debug, "S: %d %s", code, msg)
+		if code == 334 {
+			// The server sends a JSON error as a challenge; an empty reply
+			// gets the final status.
+			_, err := smtpCmdExpect(text, debug, "", []int{235})
+			return err
 		}
-		dsn := fmt.Sprintf("sqlserver://%s:%s@%s:%d?database=%s", config.User, config.Pass, config.Host, port, config.Name)
-		return dsn, "sqlserver", nil
-	case "clickhouse":
-		port := config.Port
-		if port == 0 {
-			port = 9000
+		if code != 235 {
+			return fmt.Errorf("smtp unexpected response: %w", &textproto.Error{Code: code, Msg: msg})
 		}
-		if strings.TrimSpace(config.Host) == "" {
-			return "", "", errors.New("db.host is required")
+		return nil
+	case "LOGIN":
+		if _, err := smtpCmdExpect(text, debug, "AUTH LOGIN", []int{334}); err != nil {
+			return err
 		}
-		if strings.TrimSpace(config.User) == "" {
-			return "", "", errors.New("db.user is required")
+		if _, err := smtpCmdExpect(text, debug, encode(config.User), []int{334}); err != nil {
+			return err
 		}
-		if strings.TrimSpace(config.Name) == "" {
-			return "", "", errors.New("db.name is required")
+		_, err := smtpCmdExpect(text, debug, encode(config.Pass), []int{235})
+		return err
+	case "CRAM-MD5":
+		msg, err := smtpCmdExpect(text, debug, "AUTH CRAM-MD5", []int{334})
+		if err != nil {
+			return err
 		}
-		sslMode := "false"
-		if strings.EqualFold(strings.TrimSpace(config.SSLMode), "require") {
-			sslMode = "true"
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(msg))
+		if err != nil {
+			return fmt.Errorf("smtp cram-md5 challenge invalid: %w", err)
 		}
-		dsn := fmt.Sprintf("clickhouse://%s:%s@%s:%d/%s?secure=%s", config.User, config.Pass, config.Host, port, config.Name, sslMode)
-		return dsn, "clickhouse", nil
+		mac := hmac.New(md5.New, []byte(config.Pass))
+		mac.Write(challenge)
+		_, err = smtpCmdExpect(text, debug, encode(config.User+" "+hex.EncodeToString(mac.Sum(nil))), []int{235})
+		return err
 	default:
-		return "", "", fmt.Errorf("unsupported db.type: %s", config.Type)
+		_, err := smtpCmdExpect(text, debug, "AUTH PLAIN "+encode("\x00"+config.User+"\x00"+config.Pass), []int{235})
+		return err
 	}
 }
 
-func formatValue(value interface{}) string {
-	if value == nil {
-		return ""
+// loginAuth implements the non-standard but widespread LOGIN mechanism,
+// which net/smtp does not provide.
+type loginAuth struct {
+	user string
+	pass string
+	host string
+}
+
+func (auth loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalSMTPHost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
 	}
-	switch typed := value.(type) {
-	case []byte:
-		return string(typed)
-	default:
-		return fmt.Sprint(value)
+	if server.Name != auth.host {
+		return "", nil, errors.New("wrong host name")
 	}
+	return "LOGIN", nil, nil
 }
 
-func buildMailBody(query string, result string, format string, contentType string, showQuery bool) string {
-	label := strings.ToUpper(format)
-	if strings.TrimSpace(label) == "" {
-		label = "CSV"
+func (auth loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
 	}
-	if strings.HasPrefix(contentType, "text/html") {
-		return buildHTMLBody(query, result, label, showQuery)
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(auth.user), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(auth.pass), nil
 	}
-	if showQuery {
-		return fmt.Sprintf("SQL Query:\n%s\n\nResult (%s):\n%s", query, label, result)
+	return nil, fmt.Errorf("unexpected LOGIN prompt: %s", fromServer)
+}
+
+func isLocalSMTPHost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+func xoauth2Payload(user, token string) []byte {
+	return []byte("user=" + user + "\x01auth=Bearer " + token + "\x01\x01")
+}
+
+// xoauth2Auth implements the SASL XOAUTH2 mechanism used by Gmail and
+// Office 365 with a pre-fetched access token.
+type xoauth2Auth struct {
+	user  string
+	token string
+}
+
+func (auth xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalSMTPHost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
 	}
-	return fmt.Sprintf("Result (%s):\n%s", label, result)
+	return "XOAUTH2", xoauth2Payload(auth.user, auth.token), nil
 }
 
-func sendMail(config SMTPConfig, body string, contentType string, attachment *Attachment, debug bool) error {
-	if debug {
-		return sendMailDebug(config, body, contentType, attachment, debug)
+func (auth xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// Error details arrive as a challenge; answer empty to get the failure.
+		return []byte{}, nil
 	}
-	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
-	debugf(debug, "smtp: server=%s", addr)
-	message := buildMessage(config, body, contentType, attachment)
+	return nil, nil
+}
 
-	recipients := append([]string{}, config.SMTPRecipients()...)
-	if len(recipients) == 0 {
-		return errors.New("no recipients specified")
+func buildMessage(config SMTPConfig, body string, contentType string, attachments []*Attachment) []byte {
+	resolvedContentType := contentType
+	if strings.TrimSpace(resolvedContentType) == "" {
+		resolvedContentType = "text/plain; charset=\"utf-8\""
 	}
-	debugf(debug, "smtp: recipients=%d", len(recipients))
+	if config.TextAlternative != "" && strings.HasPrefix(resolvedContentType, "text/html") {
+		resolvedContentType, body = alternativeBody(config.TextAlternative, body, resolvedContentType)
+	}
+	if len(attachments) > 0 {
+		return buildMultipartMessage(config, body, resolvedContentType, attachments)
+	}
+	headers := messageHeaders(config, resolvedContentType)
+	headers["Content-Transfer-Encoding"], body = encodeBody(resolvedContentType, body)
+	var builder strings.Builder
+	writeHeaders(&builder, headers)
+	builder.WriteString("\r\n")
+	builder.WriteString(body)
+	return []byte(builder.String())
+}
 
-	if config.TLS {
-		debugf(debug, "smtp: dialing with STARTTLS")
-		client, err := smtp.Dial(addr)
-		if err != nil {
-			return fmt.Errorf("smtp dial failed: %w", err)
+// reservedHeaders are built by notifysql and cannot be set in smtp.headers.
+var reservedHeaders = []string{"From", "To", "Cc", "Bcc", "Subject", "Reply-To", "Mime-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// messageHeaders returns the top-level headers of a message. smtp.headers
+// go in first so the generated ones always take precedence.
+func messageHeaders(config SMTPConfig, contentType string) map[string]string {
+	headers := map[string]string{}
+	for key, value := range config.Headers {
+		headers[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key))] = value
+	}
+	headers["From"] = encodeAddresses([]string{config.From})
+	headers["To"] = encodeAddresses(config.To)
+	headers["Subject"] = mime.QEncoding.Encode("utf-8", headerLineBreaks.Replace(messageSubject(config)))
+	headers["MIME-Version"] = "1.0"
+	headers["Content-Type"] = contentType
+	if len(config.Cc) > 0 {
+		headers["Cc"] = encodeAddresses(config.Cc)
+	}
+	if strings.TrimSpace(config.ReplyTo) != "" {
+		headers["Reply-To"] = encodeAddresses([]string{strings.TrimSpace(config.ReplyTo)})
+	}
+	if config.Environment != "" {
+		headers["X-NotifySQL-Env"] = config.Environment
+	}
+	for key, value := range config.ExtraHeaders {
+		headers[key] = value
+	}
+	return headers
+}
+
+// encodeAddresses joins addresses for a header, RFC 2047-encoding display
+// names that are not plain ASCII. ASCII addresses are kept exactly as
+// configured.
+func encodeAddresses(addresses []string) string {
+	encoded := make([]string, len(addresses))
+	for i, address := range addresses {
+		encoded[i] = address
+		if isASCII(address) {
+			continue
 		}
-		defer client.Close()
+		if parsed, err := mail.ParseAddress(address); err == nil {
+			encoded[i] = parsed.String()
+		}
+	}
+	return strings.Join(encoded, ", ")
+}
 
-		if ok, _ := client.Extension("STARTTLS"); ok {
-			debugf(debug, "smtp: starttls")
-			tlsConfig := &tls.Config{ServerName: config.Host}
-			if err := client.StartTLS(tlsConfig); err != nil {
-				return fmt.Errorf("starttls failed: %w", err)
-			}
-		} else {
-			return errors.New("smtp server does not support STARTTLS")
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// headerLineBreaks strips CR/LF from header values as a last guard against
+// header injection; validateConfig already rejects them in the config.
+var headerLineBreaks = strings.NewReplacer("\r", "", "\n", "")
+
+// headerOrder is the fixed position of the standard headers; everything
+// else follows sorted by name, so the same message always serializes the
+// same way (DKIM signers and golden files depend on it).
+var headerOrder = []string{"From", "To", "Cc", "Subject", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+func writeHeaders(builder *strings.Builder, headers map[string]string) {
+	written := map[string]bool{}
+	write := func(key string) {
+		builder.WriteString(key)
+		builder.WriteString(": ")
+		builder.WriteString(headerLineBreaks.Replace(headers[key]))
+		builder.WriteString("\r\n")
+		written[key] = true
+	}
+	for _, key := range headerOrder {
+		if _, ok := headers[key]; ok {
+			write(key)
+		}
+	}
+	extra := make([]string, 0, len(headers))
+	for key := range headers {
+		if !written[key] {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+	for _, key := range extra {
+		write(key)
+	}
+}
+
+// singleLine rejects CR/LF, which would let a config value start a new
+// header or SMTP command.
+func singleLine(field string, values ...string) error {
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%s must not contain line breaks", field)
 		}
+	}
+	return nil
+}
 
-		if err := smtpAuth(config, client, debug); err != nil {
+func validateHeaders(config SMTPConfig) error {
+	fields := []struct {
+		name   string
+		values []string
+	}{
+		{"smtp.from", []string{config.From}},
+		{"smtp.to", config.To},
+		{"smtp.cc", config.Cc},
+		{"smtp.bcc", config.Bcc},
+		{"smtp.subject", []string{config.Subject}},
+		{"smtp.subject_empty", []string{config.SubjectEmpty}},
+		{"smtp.reply_to", []string{config.ReplyTo}},
+	}
+	for _, field := range fields {
+		if err := singleLine(field.name, field.values...); err != nil {
 			return err
 		}
-		debugf(debug, "smtp: mail from=%s", config.From)
-		if err := client.Mail(config.From); err != nil {
-			return fmt.Errorf("smtp from failed: %w", err)
+	}
+	for key, value := range config.Headers {
+		name := strings.TrimSpace(key)
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r >= 0x7f || r == ':' }) >= 0 {
+			return fmt.Errorf("smtp.headers: invalid header name %q", key)
 		}
-		for _, recipient := range recipients {
-			debugf(debug, "smtp: rcpt=%s", recipient)
-			if err := client.Rcpt(recipient); err != nil {
-				return fmt.Errorf("smtp rcpt failed: %w", err)
+		for _, reserved := range reservedHeaders {
+			if strings.EqualFold(name, reserved) {
+				return fmt.Errorf("smtp.headers cannot set %s", reserved)
 			}
 		}
-		debugf(debug, "smtp: sending data")
-		writer, err := client.Data()
-		if err != nil {
-			return fmt.Errorf("smtp data failed: %w", err)
+		if err := singleLine("smtp.headers."+name, value); err != nil {
+			return err
 		}
-		if _, err := writer.Write(message); err != nil {
-			return fmt.Errorf("smtp write failed: %w", err)
+	}
+	return nil
+}
+
+// subjectData is what a templated smtp.subject or smtp.subject_empty sees.
+type subjectData struct {
+	RowCount int
+	Query    string
+	Now      time.Time
+	Format   string
+}
+
+func parseSubject(subject string) (*template.Template, error) {
+	return template.New("subject").Parse(subject)
+}
+
+// renderSubjects expands template actions in the subjects; plain strings
+// are left untouched.
+func renderSubjects(config *SMTPConfig, data subjectData) error {
+	for _, subject := range []*string{&config.Subject, &config.SubjectEmpty} {
+		if !strings.Contains(*subject, "{{") {
+			continue
 		}
-		if err := writer.Close(); err != nil {
-			return fmt.Errorf("smtp close failed: %w", err)
+		tmpl, err := parseSubject(*subject)
+		if err != nil {
+			return fmt.Errorf("smtp.subject template parse failed: %w", err)
+		}
+		var builder strings.Builder
+		if err := tmpl.Execute(&builder, data); err != nil {
+			return fmt.Errorf("smtp.subject template render failed: %w", err)
 		}
-		debugf(debug, "smtp: quit")
-		return client.Quit()
+		*subject = strings.TrimSpace(sanitizeCell(builder.String()))
 	}
+	return nil
+}
 
-	var auth smtp.Auth
-	if strings.TrimSpace(config.User) != "" {
-		debugf(debug, "smtp: using auth")
-		auth = smtp.PlainAuth("", config.User, config.Pass, config.Host)
-	}
-	debugf(debug, "smtp: sendmail")
-	if err := smtp.SendMail(addr, auth, config.From, recipients, message); err != nil {
-		return fmt.Errorf("smtp send failed: %w", err)
+func messageSubject(config SMTPConfig) string {
+	if config.Environment == "" {
+		return config.Subject
 	}
-	return nil
+	return "[" + strings.ToUpper(config.Environment) + "] " + config.Subject
 }
 
-func sendMailDebug(config SMTPConfig, body string, contentType string, attachment *Attachment, debug bool) error {
-	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
-	message := buildMessage(config, body, contentType, attachment)
-	recipients := append([]string{}, config.SMTPRecipients()...)
-	if len(recipients) == 0 {
-		return errors.New("no recipients specified")
+func (config SMTPConfig) SMTPRecipients() []string {
+	recipients := append([]string{}, config.To...)
+	recipients = append(recipients, config.Cc...)
+	recipients = append(recipients, config.Bcc...)
+	return recipients
+}
+
+func overrideString(current string, override string) string {
+	if strings.TrimSpace(override) == "" {
+		return current
 	}
+	return override
+}
 
-	debugf(debug, "smtp: dial %s", addr)
-	conn, err := net.Dial("tcp", addr)
+// renderSplitCSV renders one CSV per distinct value of split_attachment_by,
+// in order of first appearance. NULL keys are grouped as "null".
+func renderSplitCSV(config Config, data QueryResult) ([]*Attachment, error) {
+	index := -1
+	for i, column := range data.Columns {
+		if strings.EqualFold(column, strings.TrimSpace(config.SplitAttachmentBy)) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("split_attachment_by: column %s not found in result", config.SplitAttachmentBy)
+	}
+	var keys []string
+	groups := map[string]*QueryResult{}
+	for i, row := range data.Rows {
+		key := row[index]
+		if i < len(data.Nulls) && data.Nulls[i][index] {
+			key = "null"
+		}
+		group, ok := groups[key]
+		if !ok {
+			group = &QueryResult{Columns: data.Columns}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+		group.Rows = append(group.Rows, row)
+		if i < len(data.Nulls) {
+			group.Nulls = append(group.Nulls, data.Nulls[i])
+		}
+	}
+	base, err := attachmentBase(config, data, "csv")
 	if err != nil {
-		return fmt.Errorf("smtp dial failed: %w", err)
+		return nil, err
 	}
-	text := textproto.NewConn(conn)
-	defer func() {
-		_ = text.Close()
-		_ = conn.Close()
-	}()
-
-	if err := expectSMTPResponse(text, debug, []int{220}); err != nil {
-		return err
+	used := map[string]int{}
+	attachments := make([]*Attachment, 0, len(keys))
+	for _, key := range keys {
+		result, err := renderCSV(config, *groups[key])
+		if err != nil {
+			return nil, err
+		}
+		name := safeFilenamePart(key)
+		used[name]++
+		if used[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, used[name])
+		}
+		attachments = append(attachments, &Attachment{
+			Filename:    base + "_" + name + ".csv",
+			ContentType: "text/csv; charset=\"utf-8\"",
+			Data:        []byte(result),
+		})
 	}
+	return attachments, nil
+}
 
-	hostname := smtpHostname()
-	capabilities, err := smtpEhlo(text, debug, hostname)
-	if err != nil {
-		return err
+func safeFilenamePart(value string) string {
+	var builder strings.Builder
+	for _, r := range strings.TrimSpace(value) {
+		if r == '-' || r == '_' || r == '.' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			builder.WriteRune(r)
+		} else {
+			builder.WriteRune('_')
+		}
+	}
+	if builder.Len() == 0 {
+		return "empty"
 	}
+	return builder.String()
+}
 
-	if config.TLS {
-		if !capabilities["STARTTLS"] {
-			return errors.New("smtp server does not support STARTTLS")
+func selectColumns(data QueryResult, names []string) (QueryResult, error) {
+	if len(names) == 0 {
+		return data, nil
+	}
+	indexes := make([]int, len(names))
+	for i, name := range names {
+		indexes[i] = -1
+		for j, column := range data.Columns {
+			if strings.EqualFold(column, strings.TrimSpace(name)) {
+				indexes[i] = j
+				break
+			}
 		}
-		debugf(debug, "C: STARTTLS")
-		if _, err := smtpCmdExpect(text, debug, "STARTTLS", []int{220}); err != nil {
-			return err
+		if indexes[i] < 0 {
+			return data, fmt.Errorf("inline_columns: column %s not found in result", name)
 		}
-		tlsConn := tls.Client(conn, &tls.Config{ServerName: config.Host})
-		if err := tlsConn.Handshake(); err != nil {
-			return fmt.Errorf("starttls handshake failed: %w", err)
+	}
+	selected := QueryResult{Columns: make([]string, len(indexes))}
+	for i, index := range indexes {
+		selected.Columns[i] = data.Columns[index]
+	}
+	for r, row := range data.Rows {
+		cells := make([]string, len(indexes))
+		nulls := make([]bool, len(indexes))
+		var values []interface{}
+		if r < len(data.Values) {
+			values = make([]interface{}, len(indexes))
 		}
-		text = textproto.NewConn(tlsConn)
-		conn = tlsConn
-		capabilities, err = smtpEhlo(text, debug, hostname)
-		if err != nil {
-			return err
+		for i, index := range indexes {
+			cells[i] = row[index]
+			if r < len(data.Nulls) {
+				nulls[i] = data.Nulls[r][index]
+			}
+			if values != nil {
+				values[i] = data.Values[r][index]
+			}
+		}
+		selected.Rows = append(selected.Rows, cells)
+		selected.Nulls = append(selected.Nulls, nulls)
+		if values != nil {
+			selected.Values = append(selected.Values, values)
+		}
+	}
+	return selected, nil
+}
+
+func containsFold(values []string, target string) bool {
+	for _, value := range values {
+		if strings.EqualFold(strings.TrimSpace(value), target) {
+			return true
 		}
 	}
+	return false
+}
 
-	if strings.TrimSpace(config.User) != "" {
-		if !capabilities["AUTH"] {
-			return errors.New("smtp server does not support AUTH")
+func renderCSV(config Config, data QueryResult) (string, error) {
+	writer := newCSVWriter(config)
+	if err := writer.write(data.Columns, nil); err != nil {
+		return "", err
+	}
+	for i, row := range data.Rows {
+		var nulls []bool
+		if i < len(data.Nulls) {
+			nulls = data.Nulls[i]
 		}
-		authPayload := "\x00" + config.User + "\x00" + config.Pass
-		encoded := base64.StdEncoding.EncodeToString([]byte(authPayload))
-		debugf(debug, "C: AUTH PLAIN (redacted)")
-		if _, err := smtpCmdExpect(text, debug, "AUTH PLAIN "+encoded, []int{235}); err != nil {
-			return err
+		if err := writer.write(row, nulls); err != nil {
+			return "", err
 		}
 	}
+	return writer.finish()
+}
 
-	debugf(debug, "C: MAIL FROM:<%s>", config.From)
-	if _, err := smtpCmdExpect(text, debug, "MAIL FROM:<"+config.From+">", []int{250}); err != nil {
-		return err
+// csvWriter writes CSV records one at a time, so renderCSV and the streaming
+// count_query path produce the same file.
+type csvWriter struct {
+	builder     strings.Builder
+	writer      *csv.Writer
+	comma       rune
+	crlf        bool
+	nullAsEmpty bool
+}
+
+func newCSVWriter(config Config) *csvWriter {
+	w := &csvWriter{comma: csvComma(config), crlf: config.CSVCRLF, nullAsEmpty: config.CSVNullAsEmpty}
+	w.writer = csv.NewWriter(&w.builder)
+	w.writer.Comma = w.comma
+	w.writer.UseCRLF = w.crlf
+	return w
+}
+
+func (w *csvWriter) write(record []string, nulls []bool) error {
+	if w.nullAsEmpty {
+		writeCSVRecord(&w.builder, record, nulls, w.comma, w.crlf)
+		return nil
 	}
-	for _, recipient := range recipients {
-		debugf(debug, "C: RCPT TO:<%s>", recipient)
-		if _, err := smtpCmdExpect(text, debug, "RCPT TO:<"+recipient+">", []int{250, 251}); err != nil {
-			return err
-		}
+	if err := w.writer.Write(record); err != nil {
+		return fmt.Errorf("csv row write failed: %w", err)
 	}
-	debugf(debug, "C: DATA")
-	if _, err := smtpCmdExpect(text, debug, "DATA", []int{354}); err != nil {
-		return err
+	return nil
+}
+
+func (w *csvWriter) finish() (string, error) {
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		return "", fmt.Errorf("csv flush failed: %w", err)
 	}
-	writer := text.DotWriter()
-	if _, err := writer.Write(message); err != nil {
-		return fmt.Errorf("smtp write failed: %w", err)
+	return w.builder.String(), nil
+}
+
+// csvSink applies the per-cell steps run would otherwise do on the whole
+// result (humanize_columns, [[column]] formats, null_string) to each
+// streamed row before writing it.
+type csvSink struct {
+	config  Config
+	columns []string
+	csv     *csvWriter
+}
+
+func (s *csvSink) writeHeader(columns []string) error {
+	s.columns = columns
+	return s.csv.write(columns, nil)
+}
+
+func (s *csvSink) writeRow(row []string, nulls []bool) error {
+	single := QueryResult{Columns: s.columns, Rows: [][]string{row}, Nulls: [][]bool{nulls}}
+	humanizeResult(s.config.HumanizeColumns, single)
+	applyColumnRules(s.config, single)
+	single = fillNulls(s.config, "csv", single)
+	return s.csv.write(single.Rows[0], nulls)
+}
+
+func csvComma(config Config) rune {
+	if config.CSVDelimiter == "" {
+		return ','
 	}
-	if err := writer.Close(); err != nil {
-		return fmt.Errorf("smtp close failed: %w", err)
+	comma, _ := utf8.DecodeRuneInString(config.CSVDelimiter)
+	return comma
+}
+
+func validateCSVDelimiter(value string) error {
+	if value == "" {
+		return nil
 	}
-	if err := expectSMTPResponse(text, debug, []int{250}); err != nil {
-		return err
+	comma, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || comma == utf8.RuneError {
+		return fmt.Errorf("csv_delimiter must be a single character: %q", value)
 	}
-	debugf(debug, "C: QUIT")
-	if _, err := smtpCmdExpect(text, debug, "QUIT", []int{221}); err != nil {
-		return err
+	if comma == '"' || comma == '\r' || comma == '\n' || comma == 0 {
+		return fmt.Errorf("csv_delimiter cannot be %q", value)
 	}
 	return nil
 }
 
-func smtpEhlo(conn *textproto.Conn, debug bool, hostname string) (map[string]bool, error) {
-	debugf(debug, "C: EHLO %s", hostname)
-	msg, err := smtpCmdExpect(conn, debug, "EHLO "+hostname, []int{250})
-	if err != nil {
-		return nil, err
-	}
-	capabilities := map[string]bool{}
-	for _, line := range strings.Split(msg, "\n") {
-		fields := strings.Fields(line)
-		if len(fields) == 0 {
+// writeCSVRecord is used for csv_null_as_empty: encoding/csv never quotes
+// empty fields, so NULL vs "" needs a hand-written record.
+func writeCSVRecord(builder *strings.Builder, record []string, nulls []bool, comma rune, crlf bool) {
+	for i, field := range record {
+		if i > 0 {
+			builder.WriteRune(comma)
+		}
+		if i < len(nulls) && nulls[i] {
+			continue
+		}
+		if field == "" || csvFieldNeedsQuotes(field, comma) {
+			builder.WriteString("\"")
+			builder.WriteString(strings.ReplaceAll(field, "\"", "\"\""))
+			builder.WriteString("\"")
 			continue
 		}
-		capabilities[strings.ToUpper(fields[0])] = true
+		builder.WriteString(field)
 	}
-	return capabilities, nil
+	if crlf {
+		builder.WriteString("\r\n")
+		return
+	}
+	builder.WriteString("\n")
 }
 
-func smtpCmdExpect(conn *textproto.Conn, debug bool, cmd string, expected []int) (string, error) {
-	if err := conn.PrintfLine(cmd); err != nil {
-		return "", fmt.Errorf("smtp write failed: %w", err)
+func csvFieldNeedsQuotes(field string, comma rune) bool {
+	if field == "" {
+		return false
 	}
-	code, msg, err := readSMTPResponse(conn)
-	if err != nil {
-		return "", err
+	if field == `\.` {
+		return true
 	}
-	debugf(debug, "S: %d %s", code, msg)
-	for _, allowed := range expected {
-		if code == allowed {
-			return msg, nil
-		}
+	if strings.ContainsRune(field, comma) || strings.ContainsAny(field, "\"\r\n") {
+		return true
 	}
-	return "", fmt.Errorf("smtp unexpected response: %d %s", code, msg)
+	return field[0] == ' ' || field[0] == '\t'
 }
 
-func expectSMTPResponse(conn *textproto.Conn, debug bool, expected []int) error {
-	code, msg, err := readSMTPResponse(conn)
-	if err != nil {
-		return err
-	}
-	debugf(debug, "S: %d %s", code, msg)
-	for _, allowed := range expected {
-		if code == allowed {
-			return nil
+func renderJSON(data QueryResult) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i := range data.Rows {
+		if i > 0 {
+			buffer.WriteString(",")
 		}
+		object, err := renderJSONRow(data, i)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(object)
 	}
-	return fmt.Errorf("smtp unexpected response: %d %s", code, msg)
+	buffer.WriteString("]")
+	return buffer.Bytes(), nil
 }
 
-func readSMTPResponse(conn *textproto.Conn) (int, string, error) {
-	line, err := conn.ReadLine()
+// renderJSONSchema wraps the rows in an object with a schema section that
+// maps each column name to its database and Go scan type.
+func renderJSONSchema(data QueryResult) ([]byte, error) {
+	rows, err := renderJSON(data)
 	if err != nil {
-		return 0, "", fmt.Errorf("smtp read failed: %w", err)
-	}
-	if len(line) < 3 {
-		return 0, "", fmt.Errorf("smtp invalid response: %s", line)
+		return nil, err
 	}
-	code, err := strconv.Atoi(line[:3])
-	if err != nil {
-		return 0, "", fmt.Errorf("smtp invalid response code: %s", line)
+	var buffer bytes.Buffer
+	buffer.WriteString(`{"schema":{`)
+	for i, column := range data.Columns {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		var columnType ColumnType
+		if len(data.Types) == len(data.Columns) {
+			columnType = data.Types[i]
+		}
+		key, err := json.Marshal(column)
+		if err != nil {
+			return nil, fmt.Errorf("json encode failed: %w", err)
+		}
+		value, err := json.Marshal(columnType)
+		if err != nil {
+			return nil, fmt.Errorf("json encode failed: %w", err)
+		}
+		buffer.Write(key)
+		buffer.WriteString(":")
+		buffer.Write(value)
 	}
-	message := ""
-	if len(line) > 4 {
-		message = line[4:]
+	buffer.WriteString(`},"rows":`)
+	buffer.Write(rows)
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+func renderJSONRow(data QueryResult, index int) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	row := data.Rows[index]
+	for i, column := range data.Columns {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		key, err := json.Marshal(column)
+		if err != nil {
+			return nil, fmt.Errorf("json encode failed: %w", err)
+		}
+		buffer.Write(key)
+		buffer.WriteString(":")
+		if index < len(data.Nulls) && data.Nulls[index][i] {
+			buffer.WriteString("null")
+			continue
+		}
+		value, err := json.Marshal(row[i])
+		if err != nil {
+			return nil, fmt.Errorf("json encode failed: %w", err)
+		}
+		buffer.Write(value)
 	}
-	if len(line) > 3 && line[3] == '-' {
-		for {
-			more, err := conn.ReadLine()
-			if err != nil {
-				return 0, "", fmt.Errorf("smtp read failed: %w", err)
-			}
-			if len(more) > 4 {
-				message += "\n" + more[4:]
-			}
-			if strings.HasPrefix(more, fmt.Sprintf("%03d ", code)) {
-				break
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+func renderMarkdown(columns []string, rows [][]string, aligns []string) string {
+	var builder strings.Builder
+	builder.WriteString("| " + strings.Join(markdownRow(columns), " | ") + " |\n")
+	separators := make([]string, len(columns))
+	for i := range separators {
+		separators[i] = "---"
+		if i < len(aligns) {
+			switch aligns[i] {
+			case "left":
+				separators[i] = ":--"
+			case "right":
+				separators[i] = "--:"
+			case "center":
+				separators[i] = ":-:"
 			}
 		}
 	}
-	return code, message, nil
+	builder.WriteString("| " + strings.Join(separators, " | ") + " |")
+	for _, row := range rows {
+		builder.WriteString("\n| " + strings.Join(markdownRow(row), " | ") + " |")
+	}
+	return builder.String()
 }
 
-func smtpHostname() string {
-	hostname, err := os.Hostname()
-	if err != nil || strings.TrimSpace(hostname) == "" {
-		return "localhost"
+func markdownRow(row []string) []string {
+	clean := make([]string, len(row))
+	for i, cell := range row {
+		clean[i] = strings.ReplaceAll(sanitizeCell(cell), "|", "\\|")
 	}
-	return hostname
+	return clean
 }
 
-func smtpAuth(config SMTPConfig, client *smtp.Client, debug bool) error {
-	if strings.TrimSpace(config.User) == "" {
-		return nil
+func renderText(config Config, data QueryResult) string {
+	clean := sanitizeRow
+	if config.TextEscape {
+		clean = escapeRow
 	}
-	if ok, _ := client.Extension("AUTH"); !ok {
-		return errors.New("smtp server does not support AUTH")
-	}
-	debugf(debug, "smtp: auth")
-	auth := smtp.PlainAuth("", config.User, config.Pass, config.Host)
-	if err := client.Auth(auth); err != nil {
-		return fmt.Errorf("smtp auth failed: %w", err)
+	var builder strings.Builder
+	builder.WriteString(strings.Join(clean(data.Columns), "\t"))
+	for _, row := range data.Rows {
+		builder.WriteString("\n")
+		builder.WriteString(strings.Join(clean(truncateRow(row, config.MaxCellWidth)), "\t"))
 	}
-	return nil
+	return builder.String()
 }
 
-func buildMessage(config SMTPConfig, body string, contentType string, attachment *Attachment) []byte {
-	resolvedContentType := contentType
-	if strings.TrimSpace(resolvedContentType) == "" {
-		resolvedContentType = "text/plain; charset=\"utf-8\""
+// renderTableText draws an ASCII box table with every column padded to its
+// widest cell, like the mysql client. Widths are counted in runes.
+func renderTableText(config Config, data QueryResult) string {
+	header := sanitizeRow(data.Columns)
+	widths := make([]int, len(header))
+	for i, column := range header {
+		widths[i] = utf8.RuneCountInString(column)
 	}
-	if attachment != nil {
-		return buildMultipartMessage(config, body, resolvedContentType, attachment)
-	}
-	headers := map[string]string{
-		"From":         config.From,
-		"To":           strings.Join(config.To, ", "),
-		"Subject":      config.Subject,
-		"MIME-Version": "1.0",
-		"Content-Type": resolvedContentType,
+	rows := make([][]string, len(data.Rows))
+	for r, row := range data.Rows {
+		rows[r] = sanitizeRow(truncateRow(row, config.MaxCellWidth))
+		for i, cell := range rows[r] {
+			if i < len(widths) && utf8.RuneCountInString(cell) > widths[i] {
+				widths[i] = utf8.RuneCountInString(cell)
+			}
+		}
 	}
-	if len(config.Cc) > 0 {
-		headers["Cc"] = strings.Join(config.Cc, ", ")
+	separator := "+"
+	for _, width := range widths {
+		separator += strings.Repeat("-", width+2) + "+"
 	}
+	aligns := columnAligns(config, data.Columns)
 	var builder strings.Builder
-	for key, value := range headers {
-		builder.WriteString(key)
-		builder.WriteString(": ")
-		builder.WriteString(value)
-		builder.WriteString("\r\n")
+	writeRow := func(cells []string, aligns []string) {
+		builder.WriteString("|")
+		for i, width := range widths {
+			cell := ""
+			if i < len(cells) {
+				cell = cells[i]
+			}
+			builder.WriteString(" " + padCell(cell, width, aligns[i]) + " |")
+		}
+		builder.WriteString("\n")
 	}
-	builder.WriteString("\r\n")
-	builder.WriteString(body)
-	return []byte(builder.String())
+	builder.WriteString(separator + "\n")
+	writeRow(header, make([]string, len(widths)))
+	builder.WriteString(separator + "\n")
+	for _, row := range rows {
+		writeRow(row, aligns)
+	}
+	builder.WriteString(separator)
+	return builder.String()
 }
 
-func (config SMTPConfig) SMTPRecipients() []string {
-	recipients := append([]string{}, config.To...)
-	recipients = append(recipients, config.Cc...)
-	recipients = append(recipients, config.Bcc...)
-	return recipients
+func padCell(value string, width int, align string) string {
+	gap := width - utf8.RuneCountInString(value)
+	switch align {
+	case "right":
+		return strings.Repeat(" ", gap) + value
+	case "center":
+		return strings.Repeat(" ", gap/2) + value + strings.Repeat(" ", gap-gap/2)
+	}
+	return value + strings.Repeat(" ", gap)
 }
 
-func overrideString(current string, override string) string {
-	if strings.TrimSpace(override) == "" {
-		return current
+// truncateCell shortens value to width runes, the last being an ellipsis.
+// It counts runes, not bytes, so multibyte characters are never split.
+func truncateCell(value string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(value) <= width {
+		return value
 	}
-	return override
+	runes := []rune(value)
+	return string(runes[:width-1]) + "…"
 }
 
-func normalizeOutput(value string) (string, error) {
-	if strings.TrimSpace(value) == "" {
-		return "csv", nil
+func truncateRow(row []string, width int) []string {
+	if width <= 0 {
+		return row
 	}
-	format := strings.ToLower(strings.TrimSpace(value))
-	switch format {
-	case "csv":
-		return "csv", nil
-	case "table":
-		return "table", nil
-	case "text":
-		return "text", nil
-	default:
-		return "", fmt.Errorf("unsupported output format: %s", value)
+	truncated := make([]string, len(row))
+	for i, cell := range row {
+		truncated[i] = truncateCell(cell, width)
 	}
+	return truncated
 }
 
-func renderOutput(format string, columns []string, rows [][]string) (string, string, *Attachment, error) {
-	normalized, err := normalizeOutput(format)
-	if err != nil {
-		return "", "", nil, err
+func renderTableHTML(config Config, data QueryResult) string {
+	statusIndex := -1
+	if strings.TrimSpace(config.StatusColumn) != "" {
+		for i, column := range data.Columns {
+			if strings.EqualFold(column, config.StatusColumn) {
+				statusIndex = i
+				break
+			}
+		}
 	}
-	if len(rows) == 0 {
-		return "No rows returned.", "text/plain; charset=\"utf-8\"", nil, nil
+	hidden := statusIndex >= 0 && config.StatusColumnHidden
+	aligns := columnAligns(config, data.Columns)
+
+	var builder strings.Builder
+	tableStyle := "border-collapse:collapse;"
+	if config.TableResponsive {
+		builder.WriteString("<div style=\"width:100%;max-width:100%;overflow-x:auto;-webkit-overflow-scrolling:touch;\">\n")
+		tableStyle += "min-width:100%;white-space:nowrap;"
 	}
-	if normalized == "table" {
-		return renderTableHTML(columns, rows), "text/html; charset=\"utf-8\"", nil, nil
+	builder.WriteString("<table border=\"1\" cellpadding=\"4\" cellspacing=\"0\" style=\"" + tableStyle + "\">\n")
+	builder.WriteString("<thead><tr>")
+	for i, column := range data.Columns {
+		if hidden && i == statusIndex {
+			continue
+		}
+		builder.WriteString("<th" + cellStyle(aligns[i], "") + ">")
+		builder.WriteString(html.EscapeString(column))
+		builder.WriteString("</th>")
 	}
-	if normalized == "text" {
-		return renderText(columns, rows), "text/plain; charset=\"utf-8\"", nil, nil
+	builder.WriteString("</tr></thead>\n")
+	builder.WriteString("<tbody>\n")
+	for r, row := range data.Rows {
+		var values []interface{}
+		if r < len(data.Values) {
+			values = data.Values[r]
+		}
+		rowColor, cellColors := highlightColors(config.Highlights, data.Columns, row, values)
+		if rowColor == "" && statusIndex >= 0 && statusIndex < len(row) {
+			rowColor = statusColor(config.StatusColors, row[statusIndex])
+		}
+		builder.WriteString("<tr" + cellStyle("", rowColor) + ">")
+		for i, cell := range row {
+			if hidden && i == statusIndex {
+				continue
+			}
+			align := ""
+			if i < len(aligns) {
+				align = aligns[i]
+			}
+			builder.WriteString("<td" + cellStyle(align, cellColors[i]) + ">")
+			builder.WriteString(html.EscapeString(truncateCell(sanitizeCell(cell), config.MaxCellWidth)))
+			builder.WriteString("</td>")
+		}
+		builder.WriteString("</tr>\n")
 	}
-	result, err := renderCSV(columns, rows)
-	if err != nil {
-		return "", "", nil, err
+	builder.WriteString("</tbody></table>")
+	if config.TableResponsive {
+		builder.WriteString("\n</div>")
 	}
-	return "CSV result attached as result.csv.", "text/plain; charset=\"utf-8\"", &Attachment{
-		Filename:    "result.csv",
-		ContentType: "text/csv; charset=\"utf-8\"",
-		Data:        []byte(result),
-	}, nil
+	return builder.String()
 }
 
-func renderCSV(columns []string, rows [][]string) (string, error) {
-	var buffer bytes.Buffer
-	writer := csv.NewWriter(&buffer)
-	if err := writer.Write(columns); err != nil {
-		return "", fmt.Errorf("csv header write failed: %w", err)
+func cellStyle(align, color string) string {
+	style := ""
+	if align != "" {
+		style += "text-align:" + align + ";"
 	}
-	for _, row := range rows {
-		if err := writer.Write(row); err != nil {
-			return "", fmt.Errorf("csv row write failed: %w", err)
+	if color != "" {
+		style += "background-color:" + color + ";"
+	}
+	if style == "" {
+		return ""
+	}
+	return " style=\"" + style + "\""
+}
+
+// HighlightRule colors a table cell, or its whole row, when the column value
+// matches. Rules are checked in order and the first match wins.
+type HighlightRule struct {
+	Column string `toml:"column"`
+	Op     string `toml:"op"`
+	Value  string `toml:"value"`
+	Color  string `toml:"color"`
+	Row    bool   `toml:"row"`
+}
+
+// matches tests one cell. raw is the scanned value behind it, or noValue
+// for -render-from input.
+func (rule HighlightRule) matches(value string, raw interface{}) bool {
+	value = strings.TrimSpace(value)
+	want := strings.TrimSpace(rule.Value)
+	got, gotOK := cellNumber(value, raw)
+	limit, limitErr := strconv.ParseFloat(want, 64)
+	numeric := gotOK && limitErr == nil
+	switch strings.ToLower(strings.TrimSpace(rule.Op)) {
+	case "gt":
+		return numeric && got > limit
+	case "lt":
+		return numeric && got < limit
+	case "eq":
+		if numeric {
+			return got == limit
 		}
+		return value == want
+	case "contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(want))
 	}
-	writer.Flush()
-	if err := writer.Error(); err != nil {
-		return "", fmt.Errorf("csv flush failed: %w", err)
+	return false
+}
+
+// noValue stands in for a scanned value that is not there, as opposed to a
+// NULL one.
+var noValue = struct{}{}
+
+// cellNumber reads a cell as a number from its scanned value, so that
+// number_format grouping or a [[column]] format such as "$%.2f" does not
+// hide it. Without a scanned value the rendered text is parsed instead.
+func cellNumber(value string, raw interface{}) (float64, bool) {
+	if raw == noValue {
+		number, err := strconv.ParseFloat(value, 64)
+		return number, err == nil
 	}
-	return buffer.String(), nil
+	switch raw.(type) {
+	case nil, bool, time.Time:
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(formatValue(raw, formatOptions{DatetimeFormat: time.RFC3339Nano})), 64)
+	return number, err == nil
 }
 
-func renderText(columns []string, rows [][]string) string {
-	var builder strings.Builder
-	builder.WriteString(strings.Join(columns, "\t"))
-	for _, row := range rows {
-		builder.WriteString("\n")
-		builder.WriteString(strings.Join(sanitizeRow(row), "\t"))
+// highlightColors returns the row color and per-cell colors for one row.
+// values are the row's scanned values, nil when there are none.
+func highlightColors(rules []HighlightRule, columns []string, row []string, values []interface{}) (string, []string) {
+	rowColor := ""
+	cells := make([]string, len(row))
+	for _, rule := range rules {
+		for i, column := range columns {
+			if i >= len(row) || !strings.EqualFold(column, strings.TrimSpace(rule.Column)) {
+				continue
+			}
+			var raw interface{} = noValue
+			if len(values) == len(row) {
+				raw = values[i]
+			}
+			if !rule.matches(row[i], raw) {
+				continue
+			}
+			if rule.Row {
+				if rowColor == "" {
+					rowColor = cssValue(rule.Color)
+				}
+			} else if cells[i] == "" {
+				cells[i] = cssValue(rule.Color)
+			}
+		}
 	}
-	return builder.String()
+	return rowColor, cells
 }
 
-func renderTableHTML(columns []string, rows [][]string) string {
-	var builder strings.Builder
-	builder.WriteString("<table border=\"1\" cellpadding=\"4\" cellspacing=\"0\" style=\"border-collapse:collapse;\">\n")
-	builder.WriteString("<thead><tr>")
-	for _, column := range columns {
-		builder.WriteString("<th>")
-		builder.WriteString(html.EscapeString(column))
-		builder.WriteString("</th>")
+func statusColor(colors map[string]string, value string) string {
+	value = strings.TrimSpace(value)
+	if color, ok := colors[value]; ok {
+		return cssValue(color)
 	}
-	builder.WriteString("</tr></thead>\n")
-	builder.WriteString("<tbody>\n")
-	for _, row := range rows {
-		builder.WriteString("<tr>")
-		for _, cell := range row {
-			builder.WriteString("<td>")
-			builder.WriteString(html.EscapeString(sanitizeCell(cell)))
-			builder.WriteString("</td>")
+	for key, color := range colors {
+		if strings.EqualFold(key, value) {
+			return cssValue(color)
+		}
+	}
+	return ""
+}
+
+// cssValue keeps configured colors from breaking out of the style attribute.
+func cssValue(value string) string {
+	var builder strings.Builder
+	for _, r := range strings.TrimSpace(value) {
+		if r == '#' || r == '(' || r == ')' || r == ',' || r == '.' || r == '%' || r == ' ' || r == '-' ||
+			r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			builder.WriteRune(r)
 		}
-		builder.WriteString("</tr>\n")
 	}
-	builder.WriteString("</tbody></table>")
 	return builder.String()
 }
 
@@ -887,17 +5514,52 @@ func sanitizeRow(row []string) []string {
 	return clean
 }
 
-func buildHTMLBody(query string, result string, label string, showQuery bool) string {
+func escapeCell(value string) string {
+	var builder strings.Builder
+	for _, r := range value {
+		switch {
+		case r == '\\':
+			builder.WriteString(`\\`)
+		case r == '\t':
+			builder.WriteString(`\t`)
+		case r == '\n':
+			builder.WriteString(`\n`)
+		case r == '\r':
+			builder.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r <= 0x9f):
+			builder.WriteString(fmt.Sprintf(`\x%02x`, r))
+		default:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+func escapeRow(row []string) []string {
+	clean := make([]string, len(row))
+	for i, cell := range row {
+		clean[i] = escapeCell(cell)
+	}
+	return clean
+}
+
+func htmlQuerySection(query reportQuery) string {
+	section := "<p><strong>SQL Query:</strong></p><pre>" + html.EscapeString(query.SQL) + "</pre>"
+	if len(query.Params) > 0 {
+		section += "<p><strong>Parameters:</strong></p><pre>" + html.EscapeString(strings.Join(query.Params, "\n")) + "</pre>"
+		section += "<p><strong>Effective Query:</strong></p><pre>" + html.EscapeString(query.Effective) + "</pre>"
+	}
+	return section
+}
+
+func buildHTMLBody(query reportQuery, result string, label string, showQuery bool) string {
+	section := ""
 	if showQuery {
-		return fmt.Sprintf(
-			"<html><body><p><strong>SQL Query:</strong></p><pre>%s</pre><p><strong>Result (%s):</strong></p>%s</body></html>",
-			html.EscapeString(query),
-			html.EscapeString(label),
-			result,
-		)
+		section = htmlQuerySection(query)
 	}
 	return fmt.Sprintf(
-		"<html><body><p><strong>Result (%s):</strong></p>%s</body></html>",
+		"<html><body>%s<p><strong>Result (%s):</strong></p>%s</body></html>",
+		section,
 		html.EscapeString(label),
 		result,
 	)
@@ -909,39 +5571,63 @@ type Attachment struct {
 	Data        []byte
 }
 
-func buildMultipartMessage(config SMTPConfig, body string, contentType string, attachment *Attachment) []byte {
-	boundary := fmt.Sprintf("notifysql-%d", time.Now().UnixNano())
-	headers := map[string]string{
-		"From":         config.From,
-		"To":           strings.Join(config.To, ", "),
-		"Subject":      config.Subject,
-		"MIME-Version": "1.0",
-		"Content-Type": fmt.Sprintf("multipart/mixed; boundary=\"%s\"", boundary),
-	}
-	if len(config.Cc) > 0 {
-		headers["Cc"] = strings.Join(config.Cc, ", ")
-	}
+// alternativeBody wraps an HTML body and its plain-text fallback in a
+// multipart/alternative part; clients show the last part they can render.
+func alternativeBody(text string, htmlBody string, htmlType string) (string, string) {
+	boundary := fmt.Sprintf("notifysql-alt-%d", time.Now().UnixNano())
 	var builder strings.Builder
-	for key, value := range headers {
-		builder.WriteString(key)
-		builder.WriteString(": ")
-		builder.WriteString(value)
+	for _, part := range []struct{ contentType, body string }{{textPlain, text}, {htmlType, htmlBody}} {
+		encoding, encoded := encodeBody(part.contentType, part.body)
+		builder.WriteString("--" + boundary + "\r\n")
+		builder.WriteString("Content-Type: " + part.contentType + "\r\n")
+		builder.WriteString("Content-Transfer-Encoding: " + encoding + "\r\n\r\n")
+		builder.WriteString(encoded)
 		builder.WriteString("\r\n")
 	}
+	builder.WriteString("--" + boundary + "--\r\n")
+	return fmt.Sprintf("multipart/alternative; boundary=\"%s\"", boundary), builder.String()
+}
+
+// encodeBody returns the transfer encoding and encoded form of a body part.
+// Text is quoted-printable so wide table rows stay under the 998-byte SMTP
+// line limit; a multipart body is already made of encoded parts.
+func encodeBody(contentType string, body string) (string, string) {
+	if strings.HasPrefix(contentType, "multipart/") {
+		return "7bit", body
+	}
+	var builder strings.Builder
+	writer := quotedprintable.NewWriter(&builder)
+	_, _ = writer.Write([]byte(body))
+	_ = writer.Close()
+	return "quoted-printable", builder.String()
+}
+
+func buildMultipartMessage(config SMTPConfig, body string, contentType string, attachments []*Attachment) []byte {
+	boundary := fmt.Sprintf("notifysql-%d", time.Now().UnixNano())
+	headers := messageHeaders(config, fmt.Sprintf("multipart/mixed; boundary=\"%s\"", boundary))
+	var builder strings.Builder
+	writeHeaders(&builder, headers)
 	builder.WriteString("\r\n")
 	builder.WriteString("--" + boundary + "\r\n")
+	encoding, encoded := encodeBody(contentType, body)
 	builder.WriteString("Content-Type: " + contentType + "\r\n")
-	builder.WriteString("Content-Transfer-Encoding: 7bit\r\n\r\n")
-	builder.WriteString(body)
+	builder.WriteString("Content-Transfer-Encoding: " + encoding + "\r\n\r\n")
+	builder.WriteString(encoded)
 	builder.WriteString("\r\n")
 
-	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
-	builder.WriteString("--" + boundary + "\r\n")
-	builder.WriteString("Content-Type: " + attachment.ContentType + "\r\n")
-	builder.WriteString("Content-Disposition: attachment; filename=\"" + attachment.Filename + "\"\r\n")
-	builder.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
-	builder.WriteString(wrapBase64(encoded))
-	builder.WriteString("\r\n--" + boundary + "--\r\n")
+	for _, attachment := range attachments {
+		builder.WriteString("--" + boundary + "\r\n")
+		builder.WriteString("Content-Type: " + attachment.ContentType + "\r\n")
+		builder.WriteString("Content-Disposition: attachment; filename=\"" + attachment.Filename + "\"\r\n")
+		builder.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		if config.DryRun {
+			builder.WriteString(fmt.Sprintf("[%d bytes, base64 omitted]\r\n", len(attachment.Data)))
+			continue
+		}
+		builder.WriteString(wrapBase64(base64.StdEncoding.EncodeToString(attachment.Data)))
+		builder.WriteString("\r\n")
+	}
+	builder.WriteString("--" + boundary + "--\r\n")
 	return []byte(builder.String())
 }
 
@@ -991,7 +5677,7 @@ func flagPassed(name string) bool {
 }
 
 func fatal(err error) {
-	_, _ = fmt.Fprintln(os.Stderr, err)
+	logger.println(err)
 	os.Exit(1)
 }
 
@@ -999,5 +5685,5 @@ func debugf(enabled bool, format string, args ...interface{}) {
 	if !enabled {
 		return
 	}
-	_, _ = fmt.Fprintf(os.Stderr, "[debug] "+format+"\n", args...)
+	logger.printf("[debug] "+format, args...)
 }
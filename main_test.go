@@ -0,0 +1,838 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"mime"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/denisenkom/go-mssqldb/msdsn"
+	"github.com/go-pdf/fpdf"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/robfig/cron/v3"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+func TestRenderCSVNulls(t *testing.T) {
+	data := QueryResult{
+		Columns: []string{"id", "note", "tag"},
+		Rows:    [][]string{{"1", "", ""}, {"2", "a,b", "x"}},
+		Nulls:   [][]bool{{false, true, false}, {false, false, false}},
+	}
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"default", Config{}, "id,note,tag\n1,,\n2,\"a,b\",x\n"},
+		{"null as empty", Config{CSVNullAsEmpty: true}, "id,note,tag\n1,,\"\"\n2,\"a,b\",x\n"},
+		{"null as empty crlf", Config{CSVNullAsEmpty: true, CSVCRLF: true}, "id,note,tag\r\n1,,\"\"\r\n2,\"a,b\",x\r\n"},
+		{"null_string", Config{NullString: `\N`}, "id,note,tag\n1,\\N,\n2,\"a,b\",x\n"},
+	}
+	for _, test := range tests {
+		got, err := renderCSV(test.config, fillNulls(test.config, "csv", data))
+		if err != nil {
+			t.Fatalf("%s: renderCSV: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: renderCSV = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		backslash bool
+		want      []string
+	}{
+		{"line comment", "select 1; -- drop; DELETE FROM t;\nselect 2", false, []string{"select 1", "-- drop; DELETE FROM t;\nselect 2"}},
+		{"block comment", "select 1 /* ; DELETE FROM t; */; select 2", false, []string{"select 1 /* ; DELETE FROM t; */", "select 2"}},
+		{"string", "select 'a;b', 'DELETE;'; select 2", false, []string{"select 'a;b', 'DELETE;'", "select 2"}},
+		{"doubled quote", "select 'it''s; fine'; select 2", false, []string{"select 'it''s; fine'", "select 2"}},
+		{"dollar quote", "do $$ begin; end $$; select 2", false, []string{"do $$ begin; end $$", "select 2"}},
+		{"comment only", "select 1; -- DELETE;", false, []string{"select 1"}},
+		{"standard backslash", `select 'C:\'; select 2`, false, []string{`select 'C:\'`, "select 2"}},
+		{"mysql backslash", `select 'a\';b'; select 2`, true, []string{`select 'a\';b'`, "select 2"}},
+		{"postgres E string", `select E'a\';b'; select 2`, false, []string{`select E'a\';b'`, "select 2"}},
+	}
+	for _, test := range tests {
+		got := splitSQLStatements(test.script, test.backslash)
+		if strings.Join(got, "\x00") != strings.Join(test.want, "\x00") {
+			t.Errorf("%s: splitSQLStatements(%q) = %q, want %q", test.name, test.script, got, test.want)
+		}
+	}
+}
+
+func TestFormatValueNested(t *testing.T) {
+	id := uuid.MustParse("12345678-9abc-def0-1234-56789abcdef0")
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"array", []int32{1, 2, 3}, "[1, 2, 3]"},
+		{"empty array", []string{}, "[]"},
+		{"nested array", [][]string{{"a"}, {"b", "c"}}, "[[a], [b, c]]"},
+		{"map", map[string]uint8{"b": 2, "a": 1}, "{a: 1, b: 2}"},
+		{"tuple", []interface{}{"x", int64(1), nil}, "[x, 1, null]"},
+		{"ipv4", net.ParseIP("10.0.0.1"), "10.0.0.1"},
+		{"ipv6", net.ParseIP("2001:db8::1"), "2001:db8::1"},
+		{"uuid", id, "12345678-9abc-def0-1234-56789abcdef0"},
+		{"array of ips", []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::1")}, "[10.0.0.1, ::1]"},
+		{"map of uuids", map[string]uuid.UUID{"id": id}, "{id: 12345678-9abc-def0-1234-56789abcdef0}"},
+		{"pointer", &id, "12345678-9abc-def0-1234-56789abcdef0"},
+		{"nil pointer", (*uuid.UUID)(nil), ""},
+		{"bytes", []byte("raw"), "raw"},
+		{"time", []time.Time{time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}, "[2024-01-02T03:04:05Z]"},
+	}
+	format := formatOptions{DatetimeFormat: time.RFC3339}
+	for _, test := range tests {
+		if got := formatValue(test.value, format); got != test.want {
+			t.Errorf("%s: formatValue(%#v) = %q, want %q", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestBindNamedParamsAfterLiteral(t *testing.T) {
+	params := queryParams{Named: map[string]interface{}{"from": "2024-01-01"}}
+	tests := []struct {
+		driver string
+		query  string
+		want   string
+	}{
+		{"pgx", `select * from t where path = 'C:\' and day >= :from -- :from`, `select * from t where path = 'C:\' and day >= $1 -- :from`},
+		{"sqlserver", `select 'C:\', :from`, `select 'C:\', @p1`},
+		{"mysql", `select 'a\':from', :from`, `select 'a\':from', ?`},
+		{"pgx", `select ':from', :from::date`, `select ':from', $1::date`},
+	}
+	for _, test := range tests {
+		got, args, err := bindNamedParams(test.query, test.driver, params)
+		if err != nil {
+			t.Fatalf("%s: bindNamedParams(%q): %v", test.driver, test.query, err)
+		}
+		if got != test.want || len(args) != 1 {
+			t.Errorf("%s: bindNamedParams(%q) = %q with %d args, want %q with 1", test.driver, test.query, got, len(args), test.want)
+		}
+	}
+}
+
+// The expected output matches renderOutput from before the Renderer
+// registry, so moving the formats must not change any of them.
+func TestRenderOutputFormats(t *testing.T) {
+	data := QueryResult{
+		Columns: []string{"id", "name", "status"},
+		Rows:    [][]string{{"1", "Ada <admin>", "ok"}, {"2", "Bob, Jr.", "failed"}},
+	}
+	const table = "<table border=\"1\" cellpadding=\"4\" cellspacing=\"0\" style=\"border-collapse:collapse;\">\n"
+	tests := []struct {
+		name        string
+		config      Config
+		body        string
+		contentType string
+		attachment  string
+	}{
+		{"csv", Config{Output: "csv"}, "CSV result attached as result.csv.", textPlain, "id,name,status\n1,Ada <admin>,ok\n2,\"Bob, Jr.\",failed\n"},
+		{"text", Config{Output: "text"}, "id\tname\tstatus\n1\tAda <admin>\tok\n2\tBob, Jr.\tfailed", textPlain, ""},
+		{"text columns", Config{Output: "text", InlineColumns: []string{"status", "id"}}, "status\tid\nok\t1\nfailed\t2", textPlain, ""},
+		{"table", Config{Output: "table"}, table +
+			"<thead><tr><th>id</th><th>name</th><th>status</th></tr></thead>\n<tbody>\n" +
+			"<tr><td>1</td><td>Ada &lt;admin&gt;</td><td>ok</td></tr>\n<tr><td>2</td><td>Bob, Jr.</td><td>failed</td></tr>\n</tbody></table>",
+			"text/html; charset=\"utf-8\"", ""},
+		{"table status", Config{Output: "table", InlineColumns: []string{"name"}, StatusColumn: "status", StatusColors: map[string]string{"failed": "#ffdddd"}}, table +
+			"<thead><tr><th>name</th></tr></thead>\n<tbody>\n" +
+			"<tr><td>Ada &lt;admin&gt;</td></tr>\n<tr style=\"background-color:#ffdddd;\"><td>Bob, Jr.</td></tr>\n</tbody></table>",
+			"text/html; charset=\"utf-8\"", ""},
+	}
+	for _, test := range tests {
+		body, contentType, attachments, err := renderOutput(test.config, data)
+		if err != nil {
+			t.Fatalf("%s: renderOutput: %v", test.name, err)
+		}
+		if body != test.body || contentType != test.contentType {
+			t.Errorf("%s: renderOutput = %q (%s), want %q (%s)", test.name, body, contentType, test.body, test.contentType)
+		}
+		if test.attachment == "" {
+			if len(attachments) != 0 {
+				t.Errorf("%s: renderOutput returned %d attachments, want none", test.name, len(attachments))
+			}
+			continue
+		}
+		if len(attachments) != 1 || attachments[0].Filename != "result.csv" || string(attachments[0].Data) != test.attachment {
+			t.Errorf("%s: renderOutput attachments = %v, want result.csv with %q", test.name, attachments, test.attachment)
+		}
+	}
+	if body, _, _, _ := renderOutput(Config{Output: "csv"}, QueryResult{Columns: []string{"id"}}); body != "No rows returned." {
+		t.Errorf("renderOutput with no rows = %q, want %q", body, "No rows returned.")
+	}
+}
+
+func TestRedactDSN(t *testing.T) {
+	const pass = "p@ss:w/rd;x%"
+	for _, dbType := range []string{"mysql", "postgres", "mssql", "clickhouse"} {
+		dsn, _, err := buildDSN(DBConfig{Type: dbType, Host: "db.local", User: "report", Pass: pass, Name: "sales"})
+		if err != nil {
+			t.Fatalf("%s: buildDSN: %v", dbType, err)
+		}
+		got := redactDSN(dsn)
+		if strings.Contains(got, pass) || strings.Contains(got, url.QueryEscape(pass)) || strings.Contains(got, url.PathEscape(pass)) {
+			t.Errorf("%s: redactDSN(%q) = %q, still contains the password", dbType, dsn, got)
+		}
+		if !strings.Contains(got, redacted) || !strings.Contains(got, "report") || !strings.Contains(got, "db.local") {
+			t.Errorf("%s: redactDSN(%q) = %q, want user and host kept and the password masked", dbType, dsn, got)
+		}
+		if dsnPassword(dsn) != pass {
+			t.Errorf("%s: dsnPassword(%q) = %q, want %q", dbType, dsn, dsnPassword(dsn), pass)
+		}
+	}
+	keyword := "server=db.local;user id=report;password=secret;database=sales"
+	if got, want := redactDSN(keyword), "server=db.local;user id=report;password="+redacted+";database=sales"; got != want {
+		t.Errorf("redactDSN(%q) = %q, want %q", keyword, got, want)
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	passFile := filepath.Join(t.TempDir(), "db_pass")
+	if err := os.WriteFile(passFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config DBConfig
+		secret string
+	}{
+		{"pass", DBConfig{Type: "postgres", Host: "h", User: "u", Pass: "plain-secret", Name: "n"}, "plain-secret"},
+		{"pass_file", DBConfig{Type: "mysql", Host: "h", User: "u", PassFile: passFile, Name: "n"}, "from-file"},
+		{"dsn", DBConfig{Type: "mysql", DSN: "u:dsn-secret@tcp(h:3306)/n"}, "dsn-secret"},
+		{"dsn_template", DBConfig{Type: "mssql", User: "u", DSNTemplate: "server=h;user id={{.User}};password=tpl-secret"}, "tpl-secret"},
+	}
+	for _, test := range tests {
+		dsn, _, err := buildDSN(test.config)
+		if err != nil {
+			t.Fatalf("%s: buildDSN: %v", test.name, err)
+		}
+		original := fmt.Errorf("connect %s: %w", dsn, context.DeadlineExceeded)
+		got := redactError(original, test.config)
+		if strings.Contains(got.Error(), test.secret) {
+			t.Errorf("%s: redactError = %q, still contains the password", test.name, got)
+		}
+		if !errors.Is(got, context.DeadlineExceeded) {
+			t.Errorf("%s: redactError lost the wrapped error", test.name)
+		}
+	}
+}
+
+func TestNumericValue(t *testing.T) {
+	tests := []struct {
+		value        interface{}
+		databaseType string
+		want         bool
+	}{
+		{int64(1234567), "BIGINT", true},
+		{float64(1.5), "DOUBLE", true},
+		{[]byte("1234.50"), "DECIMAL", true},
+		{"1234.50", "NUMERIC(10,2)", true},
+		{"1234567", "VARCHAR", false},
+		{[]byte("5551234567"), "TEXT", false},
+		{"1234567", "", false},
+		{true, "BOOL", false},
+	}
+	for _, test := range tests {
+		if got := numericValue(test.value, test.databaseType); got != test.want {
+			t.Errorf("numericValue(%#v, %q) = %v, want %v", test.value, test.databaseType, got, test.want)
+		}
+	}
+}
+
+func TestDecorateBodyTiming(t *testing.T) {
+	query := reportQuery{SQL: "select 1"}
+	data := QueryResult{Columns: []string{"n"}, Rows: [][]string{{"1"}}, Elapsed: 1234 * time.Millisecond}
+	htmlType := "text/html; charset=\"utf-8\""
+	tests := []struct {
+		name        string
+		showTiming  bool
+		body        string
+		contentType string
+		want        string
+	}{
+		{"text", true, buildMailBody(query, "n\n1", "text", textPlain, false), textPlain, "Result (TEXT):\nn\n1\n\nExecuted in 1.23s"},
+		{"html", true, buildHTMLBody(query, "<table></table>", "TABLE", false), htmlType, "<html><body><p><strong>Result (TABLE):</strong></p><table></table><p>Executed in 1.23s</p></body></html>"},
+		{"off", false, buildMailBody(query, "n\n1", "text", textPlain, false), textPlain, "Result (TEXT):\nn\n1"},
+	}
+	for _, test := range tests {
+		got := decorateBody(Config{ShowTiming: test.showTiming}, data, test.body, test.contentType, nil)
+		if got != test.want {
+			t.Errorf("%s: decorateBody = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// Each generated DSN is parsed back with the driver's own parser, which must
+// recover the user and password exactly.
+func TestBuildDSNSpecialCharacters(t *testing.T) {
+	parsers := map[string]func(dsn string) (user, pass string, err error){
+		"mysql": func(dsn string) (string, string, error) {
+			config, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				return "", "", err
+			}
+			return config.User, config.Passwd, nil
+		},
+		"postgres": func(dsn string) (string, string, error) {
+			config, err := pgconn.ParseConfig(dsn)
+			if err != nil {
+				return "", "", err
+			}
+			return config.User, config.Password, nil
+		},
+		"mssql": func(dsn string) (string, string, error) {
+			config, _, err := msdsn.Parse(dsn)
+			return config.User, config.Password, err
+		},
+		"clickhouse": func(dsn string) (string, string, error) {
+			options, err := clickhouse.ParseDSN(dsn)
+			if err != nil {
+				return "", "", err
+			}
+			return options.Auth.Username, options.Auth.Password, nil
+		},
+	}
+	users := []string{"report", "domain\\report", "r@port"}
+	passwords := []string{"p@ss", "a:b/c", "with space", "x?y#z&w=1", "100%", "quote'\"back`tick", "semi;colon{}", "üñí©ødé"}
+	for dbType, parse := range parsers {
+		for _, user := range users {
+			for _, pass := range passwords {
+				dsn, _, err := buildDSN(DBConfig{Type: dbType, Host: "db.local", User: user, Pass: pass, Name: "sales"})
+				if err != nil {
+					t.Fatalf("%s: buildDSN(%q, %q): %v", dbType, user, pass, err)
+				}
+				gotUser, gotPass, err := parse(dsn)
+				if err != nil {
+					t.Errorf("%s: %q does not parse: %v", dbType, dsn, err)
+					continue
+				}
+				if gotUser != user || gotPass != pass {
+					t.Errorf("%s: %q parses as %q/%q, want %q/%q", dbType, dsn, gotUser, gotPass, user, pass)
+				}
+			}
+		}
+	}
+}
+
+func TestIPv6Hosts(t *testing.T) {
+	tests := []struct {
+		host string
+		smtp string
+		tcp  string
+	}{
+		{"::1", "[::1]:587", "tcp([::1]:3306)"},
+		{"2001:db8::10", "[2001:db8::10]:587", "tcp([2001:db8::10]:3306)"},
+		{"mail.local", "mail.local:587", "tcp(mail.local:3306)"},
+	}
+	for _, test := range tests {
+		if got := (SMTPConfig{Host: test.host, Port: 587}).addr(); got != test.smtp {
+			t.Errorf("SMTP addr for %q = %q, want %q", test.host, got, test.smtp)
+		}
+		dsn, _, err := buildDSN(DBConfig{Type: "mysql", Host: test.host, User: "report", Pass: "secret", Name: "sales"})
+		if err != nil {
+			t.Fatalf("buildDSN(%q): %v", test.host, err)
+		}
+		if !strings.Contains(dsn, "@"+test.tcp+"/") {
+			t.Errorf("mysql DSN for %q = %q, want %s", test.host, dsn, test.tcp)
+		}
+	}
+}
+
+func TestBuildMessageEncodesNonASCIIHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		subject string
+		encoded []string
+	}{
+		{"ascii", "Reports <reports@example.com>", "Ops <ops@example.com>", "Daily report", nil},
+		{"subject", "Reports <reports@example.com>", "ops@example.com", "Günlük Rapor", []string{"Subject"}},
+		{"display names", "Müşteri Hizmetleri <reports@example.com>", "Şule <sule@example.com>", "Daily report", []string{"From", "To"}},
+	}
+	for _, test := range tests {
+		config := SMTPConfig{From: test.from, To: []string{test.to}, Subject: test.subject}
+		message, err := mail.ReadMessage(strings.NewReader(string(buildMessage(config, "body", textPlain, nil))))
+		if err != nil {
+			t.Fatalf("%s: buildMessage is not a valid message: %v", test.name, err)
+		}
+		for _, header := range []string{"From", "To", "Subject"} {
+			raw := message.Header.Get(header)
+			if encoded := strings.Contains(strings.ToUpper(raw), "=?UTF-8?"); encoded != containsFold(test.encoded, header) {
+				t.Errorf("%s: %s = %q, encoded = %v", test.name, header, raw, encoded)
+			}
+		}
+		if subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject")); err != nil || subject != test.subject {
+			t.Errorf("%s: Subject decodes to %q, %v, want %q", test.name, subject, err, test.subject)
+		}
+		for header, address := range map[string]string{"From": test.from, "To": test.to} {
+			got, err := mail.ParseAddress(message.Header.Get(header))
+			want, _ := mail.ParseAddress(address)
+			if err != nil || *got != *want {
+				t.Errorf("%s: %s decodes to %v, %v, want %v", test.name, header, got, err, want)
+			}
+		}
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	const injected = "\r\nBcc: victim@example.com\r\nX-Injected: yes"
+	tests := []struct {
+		field  string
+		config SMTPConfig
+	}{
+		{"smtp.from", SMTPConfig{From: "reports@example.com" + injected, To: []string{"ops@example.com"}, Subject: "Daily"}},
+		{"smtp.to", SMTPConfig{From: "reports@example.com", To: []string{"ops@example.com" + injected}, Subject: "Daily"}},
+		{"smtp.subject", SMTPConfig{From: "reports@example.com", To: []string{"ops@example.com"}, Subject: "Daily" + injected}},
+		{"smtp.subject", SMTPConfig{From: "reports@example.com", To: []string{"ops@example.com"}, Subject: "Günlük" + injected}},
+		{"smtp.headers.X-Team", SMTPConfig{From: "reports@example.com", To: []string{"ops@example.com"}, Subject: "Daily", Headers: map[string]string{"X-Team": "ops" + injected}}},
+	}
+	for _, test := range tests {
+		if err := validateHeaders(test.config); err == nil || !strings.Contains(err.Error(), test.field) {
+			t.Errorf("validateHeaders with a line break in %s = %v, want an error naming it", test.field, err)
+		}
+		raw := string(buildMessage(test.config, "body", textPlain, nil))
+		message, err := mail.ReadMessage(strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("%s: buildMessage is not a valid message: %v", test.field, err)
+		}
+		if message.Header.Get("Bcc") != "" || message.Header.Get("X-Injected") != "" {
+			t.Errorf("%s: injected headers reached the message:\n%s", test.field, raw)
+		}
+	}
+}
+
+func TestWatermarkValue(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 8, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name   string
+		values []interface{}
+		want   string
+	}{
+		{"integers", []interface{}{int64(9999), int64(12345), nil, int64(200)}, "12345"},
+		{"decimal text", []interface{}{"9.50", "10.25", "10.3"}, "10.3"},
+		{"times", []interface{}{day(9), day(10), day(2)}, "2024-03-10T08:00:00Z"},
+		{"text", []interface{}{"b-2", "a-10"}, "b-2"},
+		{"no rows", nil, ""},
+	}
+	for _, test := range tests {
+		data := QueryResult{Columns: []string{"id"}}
+		for _, value := range test.values {
+			// The formatted cells must not matter.
+			data.Rows = append(data.Rows, []string{"1,000"})
+			data.Values = append(data.Values, []interface{}{value})
+		}
+		got, err := watermarkValue(data, "ID")
+		if err != nil || got != test.want {
+			t.Errorf("%s: watermarkValue = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestHighlightColorsRawValues(t *testing.T) {
+	rules := []HighlightRule{
+		{Column: "amount", Op: "gt", Value: "1000", Color: "red"},
+		{Column: "status", Op: "contains", Value: "fail", Color: "orange", Row: true},
+	}
+	columns := []string{"amount", "status"}
+	tests := []struct {
+		name     string
+		row      []string
+		values   []interface{}
+		wantRow  string
+		wantCell string
+	}{
+		{"grouped", []string{"1,234,567.00", "ok"}, []interface{}{float64(1234567), "ok"}, "", "red"},
+		{"currency", []string{"$1500.00", "FAILED"}, []interface{}{"1500.00", "FAILED"}, "orange", "red"},
+		{"below", []string{"999", "ok"}, []interface{}{int64(999), "ok"}, "", ""},
+		{"null", []string{"", "ok"}, []interface{}{nil, "ok"}, "", ""},
+		{"render-from", []string{"2000", "ok"}, nil, "", "red"},
+	}
+	for _, test := range tests {
+		rowColor, cells := highlightColors(rules, columns, test.row, test.values)
+		if rowColor != test.wantRow || cells[0] != test.wantCell {
+			t.Errorf("%s: highlightColors = %q, %q, want %q, %q", test.name, rowColor, cells[0], test.wantRow, test.wantCell)
+		}
+	}
+}
+
+func TestThresholdMet(t *testing.T) {
+	rows := func(n int) QueryResult {
+		data := QueryResult{Columns: []string{"id"}}
+		for i := 0; i < n; i++ {
+			data.Rows = append(data.Rows, []string{fmt.Sprint(i)})
+		}
+		return data
+	}
+	tests := []struct {
+		name   string
+		config Config
+		rows   int
+		want   bool
+	}{
+		{"rows", Config{}, 1, true},
+		{"no rows", Config{}, 0, false},
+		{"below min_rows", Config{MinRows: 5}, 4, false},
+		{"at min_rows", Config{MinRows: 5}, 5, true},
+		{"above max_rows", Config{MaxRows: 3}, 4, false},
+		{"below notify_min_rows", Config{Opsgenie: OpsgenieConfig{NotifyRule: NotifyRule{NotifyMinRows: 10}}}, 9, false},
+		{"at notify_min_rows", Config{Opsgenie: OpsgenieConfig{NotifyRule: NotifyRule{NotifyMinRows: 10}}}, 10, true},
+	}
+	for _, test := range tests {
+		if got := thresholdMet(test.config, rows(test.rows)); got != test.want {
+			t.Errorf("%s: thresholdMet with %d rows = %v, want %v", test.name, test.rows, got, test.want)
+		}
+	}
+}
+
+// writeTestCA writes a self-signed CA certificate as PEM and returns its path.
+func writeTestCA(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMySQLTLS(t *testing.T) {
+	ca := writeTestCA(t)
+	tests := []struct {
+		name     string
+		config   DBConfig
+		want     string
+		wantErr  string
+		validate bool
+	}{
+		{"default", DBConfig{}, "", "", true},
+		{"require", DBConfig{SSLMode: "require"}, "true", "", true},
+		{"ca", DBConfig{TLSCAFile: ca}, "notifysql-", "", true},
+		{"require with ca", DBConfig{SSLMode: "require", TLSCAFile: ca}, "notifysql-", "", true},
+		{"skip-verify with ca", DBConfig{SSLMode: "skip-verify", TLSCAFile: ca}, "skip-verify", "", true},
+		{"preferred with ca", DBConfig{SSLMode: "preferred", TLSCAFile: ca}, "preferred", "", true},
+		{"disable with ca", DBConfig{SSLMode: "disable", TLSCAFile: ca}, "", "ssl_mode = disable", false},
+		{"aws", DBConfig{Provider: "aws"}, "", "db.tls_ca_file is required", false},
+		{"aws with ca", DBConfig{Provider: "aws", TLSCAFile: ca}, "notifysql-", "", true},
+		{"gcp skip-verify", DBConfig{Provider: "gcp", SSLMode: "skip-verify"}, "skip-verify", "", true},
+		{"azure", DBConfig{Provider: "azure"}, "true", "", true},
+	}
+	for _, test := range tests {
+		test.config.Type, test.config.Host, test.config.User, test.config.Name = "mysql", "db.example.com", "report", "sales"
+		dsn, _, err := buildDSN(test.config)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: buildDSN error = %v, want %q", test.name, err, test.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%s: buildDSN: %v", test.name, err)
+		} else if parsed, err := mysql.ParseDSN(dsn); err != nil {
+			t.Errorf("%s: DSN %q does not parse: %v", test.name, dsn, err)
+		} else if !strings.HasPrefix(parsed.TLSConfig, test.want) || (test.want == "") != (parsed.TLSConfig == "") {
+			t.Errorf("%s: DSN %q has tls=%q, want %q", test.name, dsn, parsed.TLSConfig, test.want)
+		}
+		err = validateConfig(Config{SQL: "select 1", DB: test.config, OutputFile: "out.csv"}, runOptions{})
+		if (err == nil) != test.validate {
+			t.Errorf("%s: validateConfig = %v, want error %v", test.name, err, !test.validate)
+		}
+	}
+}
+
+func TestEncodeAttachments(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		data   string
+		want   string
+	}{
+		{"single byte", Config{OutputEncoding: "iso-8859-9"}, "ad\nŞükrü\n", "ad\n\xde\xfckr\xfc\n"},
+		{"single byte replacement", Config{OutputEncoding: "iso-8859-1"}, "ad\nŞükrü\n", "ad\n?\xfckr\xfc\n"},
+		{"multi byte", Config{OutputEncoding: "shift_jis"}, "名前\n", "\x96\xbc\x91O\n"},
+		{"utf-16 single bom", Config{OutputEncoding: "utf-16"}, "ab", "\xfe\xff\x00a\x00b"},
+	}
+	for _, test := range tests {
+		attachments := []*Attachment{{Filename: "report.csv", ContentType: "text/csv; " + utf8Charset, Data: []byte(test.data)}}
+		if err := encodeAttachments(test.config, attachments); err != nil {
+			t.Fatalf("%s: encodeAttachments: %v", test.name, err)
+		}
+		if got := string(attachments[0].Data); got != test.want {
+			t.Errorf("%s: data = %q, want %q", test.name, got, test.want)
+		}
+		if strings.Contains(attachments[0].ContentType, utf8Charset) {
+			t.Errorf("%s: content type still utf-8: %s", test.name, attachments[0].ContentType)
+		}
+	}
+
+	attachments := []*Attachment{{Filename: "report.csv", ContentType: "text/csv; " + utf8Charset, Data: []byte("ad\nŞükrü\n")}}
+	err := encodeAttachments(Config{OutputEncoding: "iso-8859-1", OutputEncodingStrict: true}, attachments)
+	if err == nil || !strings.Contains(err.Error(), "'Ş' in report.csv at byte 3") {
+		t.Errorf("strict encodeAttachments error = %v", err)
+	}
+}
+
+func TestNotifyFailureDryRun(t *testing.T) {
+	config := Config{SQL: "SELECT 1"}
+	config.SMTP.DryRun = true
+	// Nothing listens on port 1, so a real post would fail.
+	config.OnFailure.WebhookURL = "http://127.0.0.1:1/hooks/secret"
+	if err := notifyFailure(config, errors.New("boom"), false); err != nil {
+		t.Fatalf("notifyFailure under dry-run: %v", err)
+	}
+}
+
+func TestSharedDB(t *testing.T) {
+	config := DBConfig{MaxOpenConns: 3}
+	first, err := sharedDB("mysql", "user:pass@tcp(127.0.0.1:3306)/shared", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sharedDB("mysql", "user:pass@tcp(127.0.0.1:3306)/shared", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("the same database got two pools")
+	}
+	if got := first.Stats().MaxOpenConnections; got != 3 {
+		t.Errorf("MaxOpenConnections = %d, want 3", got)
+	}
+	other, err := sharedDB("mysql", "user:pass@tcp(127.0.0.1:3306)/shared", DBConfig{MaxOpenConns: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == first {
+		t.Error("different pool settings share a pool")
+	}
+}
+
+func TestSourceDBPass(t *testing.T) {
+	base := DBConfig{Type: "mysql", User: "report", PassFile: "/run/secrets/db"}
+	merged := sourceDB(base, SourceConfig{DBConfig: DBConfig{Pass: "other"}})
+	if merged.Pass != "other" || merged.PassFile != "" {
+		t.Errorf("inline pass: Pass=%q PassFile=%q, want the inline pass without the inherited pass_file", merged.Pass, merged.PassFile)
+	}
+	merged = sourceDB(base, SourceConfig{DBConfig: DBConfig{Host: "replica"}})
+	if merged.PassFile != "/run/secrets/db" {
+		t.Errorf("no pass override: PassFile = %q, want the inherited pass_file", merged.PassFile)
+	}
+}
+
+func TestOutputFileContentNoRows(t *testing.T) {
+	data := QueryResult{Columns: []string{"id", "name"}}
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"csv", "id,name\n"},
+		{"text", "No rows returned."},
+	}
+	for _, test := range tests {
+		got, err := outputFileContent(Config{Output: test.output}, data)
+		if err != nil {
+			t.Fatalf("%s: outputFileContent: %v", test.output, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: outputFileContent = %q, want %q", test.output, got, test.want)
+		}
+	}
+	for _, output := range []string{"json", "xlsx", "pdf"} {
+		got, err := outputFileContent(Config{Output: output}, data)
+		if err != nil {
+			t.Fatalf("%s: outputFileContent: %v", output, err)
+		}
+		if strings.Contains(string(got), "No rows returned.") {
+			t.Errorf("%s: empty result wrote the no-rows body", output)
+		}
+	}
+}
+
+func TestValidateJobsOutputFile(t *testing.T) {
+	config := Config{
+		DB:         DBConfig{Type: "mysql", Host: "db.example.com", User: "report", Name: "sales"},
+		OutputFile: "out.csv",
+		Jobs:       []JobConfig{{Name: "a", SQL: "select 1"}, {Name: "b", SQL: "select 2"}},
+	}
+	if err := validateConfig(config, runOptions{}); err == nil || !strings.Contains(err.Error(), "output_file") {
+		t.Errorf("two jobs sharing output_file: validateConfig = %v", err)
+	}
+	config.Jobs = config.Jobs[:1]
+	if err := validateConfig(config, runOptions{}); err != nil {
+		t.Errorf("one job with output_file: validateConfig = %v", err)
+	}
+}
+
+func TestParseParamValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  interface{}
+	}{
+		{"42", int64(42)},
+		{"-3", int64(-3)},
+		{"0", int64(0)},
+		{"0.5", 0.5},
+		{"-12.25", -12.25},
+		{"true", true},
+		{"FALSE", false},
+		{"007", "007"},
+		{"00123", "00123"},
+		{"nan", "nan"},
+		{"inf", "inf"},
+		{"0x1p4", "0x1p4"},
+		{"1_000", "1_000"},
+		{"1e3", "1e3"},
+		{"+5", "+5"},
+		{"1.", "1."},
+		{"stuck", "stuck"},
+	}
+	for _, test := range tests {
+		if got := parseParamValue(test.value); got != test.want {
+			t.Errorf("parseParamValue(%q) = %#v, want %#v", test.value, got, test.want)
+		}
+	}
+	if got := watermarkParam("00123"); got != "00123" {
+		t.Errorf("watermarkParam(%q) = %#v, want the string", "00123", got)
+	}
+}
+
+func TestScheduleChain(t *testing.T) {
+	var out strings.Builder
+	saved := logger.out
+	logger.out = &out
+	defer func() { logger.out = saved }()
+
+	chain := cron.NewChain(cron.Recover(cronLog{}), cron.SkipIfStillRunning(cronLog{}))
+	chain.Then(cron.FuncJob(func() { panic("tick exploded") })).Run()
+	if !strings.Contains(out.String(), "error: schedule: panic: tick exploded") {
+		t.Errorf("recovered panic not logged: %q", out.String())
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	job := chain.Then(cron.FuncJob(func() {
+		close(started)
+		<-release
+	}))
+	done := make(chan struct{})
+	go func() {
+		job.Run()
+		close(done)
+	}()
+	<-started
+	job.Run()
+	close(release)
+	<-done
+	if !strings.Contains(out.String(), "schedule: tick skipped") {
+		t.Errorf("skipped tick not logged: %q", out.String())
+	}
+}
+
+func TestSendsEmail(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   bool
+	}{
+		{"default notify", Config{SMTP: SMTPConfig{Host: "smtp.example.com"}}, true},
+		{"slack only", Config{Notify: []string{"slack"}, SMTP: SMTPConfig{Host: "smtp.example.com"}}, false},
+		{"email and webhook", Config{Notify: []string{"webhook", "email"}}, true},
+		{"output_file without smtp", Config{OutputFile: "out.csv"}, false},
+		{"output_file with smtp", Config{OutputFile: "out.csv", SMTP: SMTPConfig{Host: "smtp.example.com"}}, true},
+	}
+	for _, test := range tests {
+		if got := sendsEmail(test.config); got != test.want {
+			t.Errorf("%s: sendsEmail = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReportBodySubjectEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "body.txt")
+	if err := os.WriteFile(path, []byte("{{.Subject}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{BodyTemplateFile: path, SMTP: SMTPConfig{Subject: "Daily orders", SubjectEmpty: "No orders today", Environment: "prod"}}
+	tests := []struct {
+		data QueryResult
+		want string
+	}{
+		{QueryResult{Columns: []string{"id"}, Rows: [][]string{{"1"}}}, "[PROD] Daily orders"},
+		{QueryResult{Columns: []string{"id"}}, "[PROD] No orders today"},
+	}
+	for _, test := range tests {
+		body, _, err := reportBody(config, test.data, queryParams{}, messageSubject(reportSMTP(config, test.data)), "", textPlain, nil, false)
+		if err != nil {
+			t.Fatalf("reportBody: %v", err)
+		}
+		if body != test.want {
+			t.Errorf("rows=%d: .Subject = %q, want %q", test.data.rowCount(), body, test.want)
+		}
+	}
+}
+
+func TestRenderPDFUnicode(t *testing.T) {
+	data := QueryResult{
+		Columns: []string{"müşteri", "şehir"},
+		Rows:    [][]string{{"Şükrü Çağlayan", strings.Repeat("İğdır", 40)}},
+	}
+	result, err := renderPDF(Config{SMTP: SMTPConfig{Subject: "Günlük Rapor"}}, data, time.Now())
+	if err != nil {
+		t.Fatalf("renderPDF: %v", err)
+	}
+	if !strings.HasPrefix(string(result), "%PDF-") || !strings.Contains(string(result), "/FontFile2") {
+		t.Error("PDF does not embed a TrueType font")
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes(pdfFont, "", goregular.TTF)
+	pdf.SetFont(pdfFont, "", pdfFontSize)
+	lines := pdfWrap(pdf, strings.Repeat("İğdır", 40), 30)
+	if len(lines) < 2 {
+		t.Fatalf("pdfWrap did not wrap: %q", lines)
+	}
+	for _, line := range lines {
+		if !utf8.ValidString(line) {
+			t.Errorf("pdfWrap cut inside a character: %q", line)
+		}
+	}
+}
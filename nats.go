@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+func publishNATS(config NATSConfig, data QueryResult, debug bool) error {
+	url := config.URL
+	if strings.TrimSpace(url) == "" {
+		url = nats.DefaultURL
+	}
+	options := []nats.Option{nats.Name("notifysql")}
+	if strings.TrimSpace(config.CredsFile) != "" {
+		options = append(options, nats.UserCredentials(config.CredsFile))
+	}
+	if strings.TrimSpace(config.Token) != "" {
+		options = append(options, nats.Token(config.Token))
+	}
+	if strings.TrimSpace(config.User) != "" {
+		options = append(options, nats.UserInfo(config.User, config.Pass))
+	}
+
+	debugf(debug, "nats: connect %s", url)
+	conn, err := nats.Connect(url, options...)
+	if err != nil {
+		return fmt.Errorf("nats connect failed: %w", err)
+	}
+	defer conn.Close()
+
+	if config.PerRow {
+		for i := range data.Rows {
+			payload, err := renderJSONRow(data, i)
+			if err != nil {
+				return err
+			}
+			if err := conn.Publish(config.Subject, payload); err != nil {
+				return fmt.Errorf("nats publish failed: %w", err)
+			}
+		}
+		debugf(debug, "nats: published %d rows to %s", len(data.Rows), config.Subject)
+	} else {
+		payload, err := renderJSON(data)
+		if err != nil {
+			return err
+		}
+		if err := conn.Publish(config.Subject, payload); err != nil {
+			return fmt.Errorf("nats publish failed: %w", err)
+		}
+		debugf(debug, "nats: published result to %s", config.Subject)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("nats flush failed: %w", err)
+	}
+	if err := conn.LastError(); err != nil {
+		return fmt.Errorf("nats publish failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	opsgenieMessageLimit     = 130
+	opsgenieDescriptionLimit = 15000
+)
+
+func sendOpsgenie(config Config, data QueryResult, triggered bool, debug bool) error {
+	opsgenie := config.Opsgenie
+	baseURL := strings.TrimRight(strings.TrimSpace(opsgenie.APIURL), "/")
+	if baseURL == "" {
+		baseURL = "https://api.opsgenie.com"
+	}
+	alias := strings.TrimSpace(opsgenie.Alias)
+	if alias == "" {
+		sum := sha256.Sum256([]byte(config.SQL))
+		alias = "notifysql-" + hex.EncodeToString(sum[:6])
+	}
+	headers := map[string]string{"Authorization": "GenieKey " + opsgenie.APIKey}
+
+	if !triggered {
+		if !opsgenie.CloseOnClear {
+			debugf(debug, "opsgenie: condition not met, nothing to send")
+			return nil
+		}
+		debugf(debug, "opsgenie: closing alert alias=%s", alias)
+		closeURL := baseURL + "/v2/alerts/" + url.PathEscape(alias) + "/close?identifierType=alias"
+		payload := map[string]interface{}{
+			"source": "notifysql",
+			"note":   "Condition cleared: query returned no matching rows.",
+		}
+		if err := postJSON(closeURL, payload, headers); err != nil {
+			return fmt.Errorf("opsgenie close %w", err)
+		}
+		return nil
+	}
+
+	message := opsgenie.Message
+	if strings.TrimSpace(message) == "" {
+		message = fmt.Sprintf("notifysql: %d rows returned", data.rowCount())
+	}
+	description := fmt.Sprintf("SQL Query:\n%s\n\nResult (%d rows):\n%s", config.SQL, data.rowCount(), renderText(config, data))
+	payload := map[string]interface{}{
+		"message":     truncateRunes(message, opsgenieMessageLimit),
+		"alias":       alias,
+		"description": truncateRunes(description, opsgenieDescriptionLimit),
+		"source":      "notifysql",
+	}
+	if strings.TrimSpace(opsgenie.Priority) != "" {
+		payload["priority"] = strings.ToUpper(strings.TrimSpace(opsgenie.Priority))
+	}
+	if len(opsgenie.Tags) > 0 {
+		payload["tags"] = opsgenie.Tags
+	}
+	debugf(debug, "opsgenie: creating alert alias=%s", alias)
+	if err := postJSON(baseURL+"/v2/alerts", payload, headers); err != nil {
+		return fmt.Errorf("opsgenie create %w", err)
+	}
+	return nil
+}
+
+func truncateRunes(value string, limit int) string {
+	if utf8.RuneCountInString(value) <= limit {
+		return value
+	}
+	runes := []rune(value)
+	return string(runes[:limit-1]) + "…"
+}
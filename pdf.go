@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+const pdfContentType = "application/pdf"
+
+// The PDF embeds the Go fonts as UTF-8 fonts, so Latin (including Turkish),
+// Greek and Cyrillic text prints as it is instead of being squeezed into the
+// Windows-1252 repertoire of the built-in PDF fonts.
+const (
+	pdfFont     = "go"
+	pdfMonoFont = "gomono"
+)
+
+// Layout in millimetres and points. The table font shrinks from
+// pdfFontSize down to pdfMinFontSize before columns start wrapping.
+const (
+	pdfMargin      = 10.0
+	pdfPadding     = 1.5
+	pdfFontSize    = 9.0
+	pdfMinFontSize = 6.0
+)
+
+func init() {
+	registerRenderer("pdf", RendererFunc(renderPDFOutput))
+}
+
+func renderPDFOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	result, err := renderPDF(config, data, time.Now())
+	if err != nil {
+		return "", "", nil, err
+	}
+	base, err := attachmentBase(config, data, "pdf")
+	if err != nil {
+		return "", "", nil, err
+	}
+	return "PDF result attached as " + base + ".pdf.", textPlain, []*Attachment{{
+		Filename:    base + ".pdf",
+		ContentType: pdfContentType,
+		Data:        result,
+	}}, nil
+}
+
+// renderPDF lays the result out as a table on A4 pages, landscape for wide
+// results, under a header with the subject, timestamp and (with show_query)
+// the query. The header row is repeated on every page.
+func renderPDF(config Config, data QueryResult, now time.Time) ([]byte, error) {
+	orientation := "P"
+	if len(data.Columns) > 5 {
+		orientation = "L"
+	}
+	pdf := fpdf.New(orientation, "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes(pdfFont, "", goregular.TTF)
+	pdf.AddUTF8FontFromBytes(pdfFont, "B", gobold.TTF)
+	pdf.AddUTF8FontFromBytes(pdfMonoFont, "", gomono.TTF)
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(true, pdfMargin+5)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-pdfMargin - 3)
+		pdf.SetFont(pdfFont, "", 7)
+		pdf.CellFormat(0, 4, fmt.Sprintf("Page %d/{nb}", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	title := messageSubject(config.SMTP)
+	if strings.TrimSpace(title) == "" {
+		title = "notifysql report"
+	}
+	pdf.SetFont(pdfFont, "B", 14)
+	pdf.MultiCell(0, 7, title, "", "L", false)
+	pdf.SetFont(pdfFont, "", 9)
+	pdf.CellFormat(0, 6, fmt.Sprintf("Generated %s, %d rows", now.Format("2006-01-02 15:04:05 MST"), data.rowCount()), "", 1, "L", false, 0, "")
+	if query := strings.TrimSpace(config.SQL); query != "" && (config.ShowQuery == nil || *config.ShowQuery) {
+		pdf.SetFont(pdfMonoFont, "", 8)
+		pdf.MultiCell(0, 3.5, strings.ReplaceAll(query, "\t", "    "), "", "L", false)
+	}
+	pdf.Ln(3)
+
+	header := sanitizeRow(data.Columns)
+	rows := make([][]string, len(data.Rows))
+	for r, row := range data.Rows {
+		cells := sanitizeRow(truncateRow(row, config.MaxCellWidth))
+		rows[r] = make([]string, len(header))
+		for i := range header {
+			if i < len(cells) {
+				rows[r][i] = cells[i]
+			}
+		}
+	}
+
+	pageWidth, pageHeight := pdf.GetPageSize()
+	fontSize, widths := pdfColumnWidths(pdf, header, rows, pageWidth-2*pdfMargin)
+	lineHeight := fontSize * 0.45
+	aligns := make([]string, len(header))
+	for i, align := range columnAligns(config, data.Columns) {
+		aligns[i] = map[string]string{"right": "R", "center": "C"}[align]
+		if aligns[i] == "" {
+			aligns[i] = "L"
+		}
+	}
+
+	var drawHeader func()
+	drawRow := func(cells []string, style string, fill bool, aligns []string) {
+		pdf.SetFont(pdfFont, style, fontSize)
+		lines := make([][]string, len(cells))
+		height := lineHeight
+		for i, cell := range cells {
+			lines[i] = pdfWrap(pdf, cell, widths[i]-2*pdfPadding)
+			if h := float64(len(lines[i])) * lineHeight; h > height {
+				height = h
+			}
+		}
+		height += pdfPadding
+		if pdf.GetY()+height > pageHeight-pdfMargin-5 {
+			pdf.AddPage()
+			if !fill {
+				drawHeader()
+				pdf.SetFont(pdfFont, style, fontSize)
+			}
+		}
+		x, y := pdfMargin, pdf.GetY()
+		for i := range cells {
+			drawStyle := "D"
+			if fill {
+				drawStyle = "FD"
+			}
+			pdf.Rect(x, y, widths[i], height, drawStyle)
+			for k, line := range lines[i] {
+				pdf.SetXY(x+pdfPadding, y+pdfPadding/2+float64(k)*lineHeight)
+				pdf.CellFormat(widths[i]-2*pdfPadding, lineHeight, line, "", 0, aligns[i], false, 0, "")
+			}
+			x += widths[i]
+		}
+		pdf.SetXY(pdfMargin, y+height)
+	}
+	drawHeader = func() {
+		pdf.SetFillColor(230, 230, 230)
+		drawRow(header, "B", true, make([]string, len(header)))
+	}
+	drawHeader()
+	for _, row := range rows {
+		drawRow(row, "", false, aligns)
+	}
+
+	var buffer bytes.Buffer
+	if err := pdf.Output(&buffer); err != nil {
+		return nil, fmt.Errorf("pdf write failed: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// pdfColumnWidths sizes each column to its widest cell. When that does not
+// fit, the font shrinks first; at pdfMinFontSize narrow columns keep their
+// width and the wide ones share the rest and wrap.
+func pdfColumnWidths(pdf *fpdf.Fpdf, header []string, rows [][]string, available float64) (float64, []float64) {
+	natural := make([]float64, len(header))
+	fontSize := pdfFontSize
+	for ; ; fontSize -= 0.5 {
+		total := 0.0
+		for i, column := range header {
+			pdf.SetFont(pdfFont, "B", fontSize)
+			natural[i] = pdf.GetStringWidth(column)
+			pdf.SetFont(pdfFont, "", fontSize)
+			for _, row := range rows {
+				if width := pdf.GetStringWidth(row[i]); width > natural[i] {
+					natural[i] = width
+				}
+			}
+			natural[i] += 2*pdfPadding + 0.5
+			total += natural[i]
+		}
+		if total <= available {
+			return fontSize, natural
+		}
+		if fontSize <= pdfMinFontSize {
+			break
+		}
+	}
+	widths := append([]float64{}, natural...)
+	fixed := make([]bool, len(widths))
+	remaining, flexible := available, len(widths)
+	for changed := true; changed && flexible > 0; {
+		changed = false
+		share := remaining / float64(flexible)
+		for i, width := range natural {
+			if !fixed[i] && width <= share {
+				fixed[i] = true
+				remaining -= width
+				flexible--
+				changed = true
+			}
+		}
+	}
+	for i := range widths {
+		if !fixed[i] {
+			widths[i] = remaining / float64(flexible)
+		}
+	}
+	return fontSize, widths
+}
+
+// pdfWrap breaks text into lines no wider than width, at spaces where
+// possible and mid-word otherwise, never inside a multibyte character.
+func pdfWrap(pdf *fpdf.Fpdf, text string, width float64) []string {
+	if pdf.GetStringWidth(text) <= width {
+		return []string{text}
+	}
+	var lines []string
+	line := ""
+	for _, word := range strings.Split(text, " ") {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if pdf.GetStringWidth(candidate) <= width {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		line = word
+		for pdf.GetStringWidth(line) > width {
+			runes := []rune(line)
+			if len(runes) <= 1 {
+				break
+			}
+			cut := len(runes) - 1
+			for cut > 1 && pdf.GetStringWidth(string(runes[:cut])) > width {
+				cut--
+			}
+			lines = append(lines, string(runes[:cut]))
+			line = string(runes[cut:])
+		}
+	}
+	return append(lines, line)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+// Renderer turns a query result into a mail body and optional attachments.
+type Renderer interface {
+	Render(config Config, data QueryResult) (body string, contentType string, attachments []*Attachment, err error)
+}
+
+// RendererFunc adapts a plain function to the Renderer interface.
+type RendererFunc func(config Config, data QueryResult) (string, string, []*Attachment, error)
+
+func (f RendererFunc) Render(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	return f(config, data)
+}
+
+var renderers = map[string]Renderer{}
+
+// registerRenderer makes a format available to the output option. Formats
+// register themselves from init so adding one does not touch renderOutput.
+func registerRenderer(name string, renderer Renderer) {
+	name = strings.ToLower(name)
+	if _, exists := renderers[name]; exists {
+		panic("renderer already registered: " + name)
+	}
+	renderers[name] = renderer
+}
+
+func rendererNames() []string {
+	names := make([]string, 0, len(renderers))
+	for name := range renderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const textPlain = "text/plain; charset=\"utf-8\""
+
+func init() {
+	registerRenderer("csv", RendererFunc(renderCSVOutput))
+	registerRenderer("table", RendererFunc(renderTableOutput))
+	registerRenderer("text", RendererFunc(renderTextOutput))
+	registerRenderer("table-text", RendererFunc(renderTableTextOutput))
+	registerRenderer("json", RendererFunc(renderJSONOutput))
+	registerRenderer("markdown", RendererFunc(renderMarkdownOutput))
+	registerRenderer("html", RendererFunc(renderHTMLOutput))
+}
+
+func normalizeOutput(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "csv", nil
+	}
+	format := strings.ToLower(strings.TrimSpace(value))
+	if _, ok := renderers[format]; !ok {
+		return "", fmt.Errorf("unsupported output format: %s (available: %s)", value, strings.Join(rendererNames(), ", "))
+	}
+	return format, nil
+}
+
+func renderOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	normalized, err := normalizeOutput(config.Output)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if data.rowCount() == 0 && len(data.ResultSets) == 0 {
+		return "No rows returned.", textPlain, nil, nil
+	}
+	body, contentType, attachments, err := renderSets(config, normalized, fillNulls(config, normalized, data))
+	if err != nil {
+		return "", "", nil, err
+	}
+	for _, name := range config.ExtraAttachments {
+		format, err := normalizeOutput(name)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("extra_attachments: %w", err)
+		}
+		if format == normalized {
+			continue
+		}
+		_, _, extra, err := renderSets(config, format, fillNulls(config, format, data))
+		if err != nil {
+			return "", "", nil, err
+		}
+		if len(extra) == 0 {
+			return "", "", nil, fmt.Errorf("extra_attachments: %s does not produce an attachment", format)
+		}
+		attachments = append(attachments, extra...)
+	}
+	if err := finishAttachments(config, attachments); err != nil {
+		return "", "", nil, err
+	}
+	return body, contentType, attachments, nil
+}
+
+// finishAttachments applies output_encoding and csv_bom to the rendered
+// attachments.
+func finishAttachments(config Config, attachments []*Attachment) error {
+	if err := encodeAttachments(config, attachments); err != nil {
+		return err
+	}
+	if config.CSVBOM {
+		addCSVBOM(attachments)
+	}
+	return nil
+}
+
+const utf8BOM = "\xEF\xBB\xBF"
+
+// addCSVBOM marks UTF-8 CSV attachments with a byte-order mark so Excel
+// detects the encoding.
+func addCSVBOM(attachments []*Attachment) {
+	for _, attachment := range attachments {
+		if strings.HasPrefix(attachment.ContentType, "text/csv") && strings.Contains(attachment.ContentType, utf8Charset) {
+			attachment.Data = append([]byte(utf8BOM), attachment.Data...)
+		}
+	}
+}
+
+const utf8Charset = "charset=\"utf-8\""
+
+// outputEncoding resolves output_encoding to an encoder and its MIME charset
+// name. A nil encoding means the output stays UTF-8.
+func outputEncoding(name string) (encoding.Encoding, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.EqualFold(name, "utf8") {
+		return nil, "utf-8", nil
+	}
+	enc, err := ianaindex.MIME.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, "", fmt.Errorf("unsupported output_encoding: %s", name)
+	}
+	charset, err := ianaindex.MIME.Name(enc)
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported output_encoding: %s", name)
+	}
+	charset = strings.ToLower(charset)
+	if charset == "utf-8" {
+		return nil, charset, nil
+	}
+	return enc, charset, nil
+}
+
+// encodeAttachments transcodes the UTF-8 text attachments (csv) to
+// output_encoding and updates their charset. Characters the target cannot
+// represent become "?" unless output_encoding_strict is set.
+func encodeAttachments(config Config, attachments []*Attachment) error {
+	enc, charset, err := outputEncoding(config.OutputEncoding)
+	if err != nil || enc == nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		if !strings.Contains(attachment.ContentType, utf8Charset) {
+			continue
+		}
+		data, offset, err := transcode(enc.NewEncoder(), attachment.Data, config.OutputEncodingStrict)
+		if err != nil {
+			r, _ := utf8.DecodeRune(attachment.Data[offset:])
+			return fmt.Errorf("output_encoding %s cannot represent %q in %s at byte %d", charset, r, attachment.Filename, offset)
+		}
+		attachment.Data = data
+		attachment.ContentType = strings.Replace(attachment.ContentType, utf8Charset, "charset=\""+charset+"\"", 1)
+	}
+	return nil
+}
+
+// transcode runs the whole of data through a single encoder, so stateful
+// encodings (a UTF-16 byte-order mark, ISO-2022 escape sequences) are written
+// once per attachment. An unrepresentable rune is replaced with "?" or, when
+// strict, reported with its byte offset.
+func transcode(encoder *encoding.Encoder, data []byte, strict bool) ([]byte, int, error) {
+	out := make([]byte, 0, len(data))
+	buf := make([]byte, 4096)
+	src := data
+	for {
+		nDst, nSrc, err := encoder.Transform(buf, src, true)
+		out = append(out, buf[:nDst]...)
+		src = src[nSrc:]
+		switch {
+		case err == nil:
+			return out, 0, nil
+		case errors.Is(err, transform.ErrShortDst):
+			if nDst == 0 && nSrc == 0 {
+				buf = make([]byte, 2*len(buf))
+			}
+			continue
+		}
+		offset := len(data) - len(src)
+		if strict {
+			return nil, offset, err
+		}
+		_, size := utf8.DecodeRune(src)
+		nDst, _, err = encoder.Transform(buf, []byte("?"), false)
+		if err != nil {
+			return nil, offset, err
+		}
+		out = append(out, buf[:nDst]...)
+		src = src[size:]
+	}
+}
+
+// renderSets renders each result set of an all_result_sets query on its own:
+// inline formats get one section per set under a heading, attachment formats
+// one file per set. html wraps its sets in a single document itself.
+func renderSets(config Config, format string, data QueryResult) (string, string, []*Attachment, error) {
+	if len(data.ResultSets) == 0 || format == "html" {
+		return renderers[format].Render(config, data)
+	}
+	first := data
+	first.ResultSets = nil
+	sets := append([]QueryResult{first}, data.ResultSets...)
+	var bodies []string
+	var attachments []*Attachment
+	contentType := textPlain
+	for i, set := range sets {
+		setConfig := config
+		if i > 0 {
+			base, err := attachmentBase(config, data, format)
+			if err != nil {
+				return "", "", nil, err
+			}
+			setConfig.AttachmentName = fmt.Sprintf("%s_%d", base, i+1)
+		}
+		body, setType := "No rows returned.", textPlain
+		if len(set.Rows) > 0 {
+			var extra []*Attachment
+			var err error
+			body, setType, extra, err = renderers[format].Render(setConfig, set)
+			if err != nil {
+				return "", "", nil, err
+			}
+			attachments = append(attachments, extra...)
+		}
+		if strings.HasPrefix(setType, "text/html") {
+			contentType = setType
+		}
+		bodies = append(bodies, body)
+	}
+	var builder strings.Builder
+	for i, body := range bodies {
+		heading := fmt.Sprintf("Result set %d", i+1)
+		if strings.HasPrefix(contentType, "text/html") {
+			if !strings.HasPrefix(body, "<") {
+				body = "<p>" + html.EscapeString(body) + "</p>"
+			}
+			builder.WriteString("<h3>" + heading + "</h3>\n" + body + "\n")
+			continue
+		}
+		if i > 0 {
+			builder.WriteString("\n\n")
+		}
+		builder.WriteString(heading + ":\n" + body)
+	}
+	return builder.String(), contentType, attachments, nil
+}
+
+func renderTableOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	names := config.InlineColumns
+	if len(names) > 0 && strings.TrimSpace(config.StatusColumn) != "" && !containsFold(names, config.StatusColumn) {
+		names = append(append([]string{}, names...), config.StatusColumn)
+		config.StatusColumnHidden = true
+	}
+	inline, err := selectColumns(data, names)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return renderTableHTML(config, inline), "text/html; charset=\"utf-8\"", nil, nil
+}
+
+func renderTextOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	inline, err := selectColumns(data, config.InlineColumns)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return renderText(config, inline), textPlain, nil, nil
+}
+
+func renderTableTextOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	inline, err := selectColumns(data, config.InlineColumns)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return renderTableText(config, inline), textPlain, nil, nil
+}
+
+// Markdown goes out as text/plain so the raw table survives for tools that
+// render it themselves.
+func renderMarkdownOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	inline, err := selectColumns(data, config.InlineColumns)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return renderMarkdown(inline.Columns, inline.Rows, columnAligns(config, inline.Columns)), textPlain, nil, nil
+}
+
+// htmlQueryMarker is replaced by buildMailBody with the query section (or
+// nothing), since show_query and the bound parameters are known only there.
+const htmlQueryMarker = "<!--notifysql:query-->"
+
+func renderHTMLOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	table, _, _, err := renderSets(config, "table", data)
+	if err != nil {
+		return "", "", nil, err
+	}
+	contentType := "text/html; charset=\"utf-8\""
+	title := messageSubject(config.SMTP)
+	if strings.TrimSpace(title) == "" {
+		title = "notifysql report"
+	}
+	var builder strings.Builder
+	builder.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>" + html.EscapeString(title) + "</title></head>\n")
+	builder.WriteString("<body style=\"font-family:Arial,Helvetica,sans-serif;font-size:14px;color:#222;\">\n")
+	builder.WriteString("<h2 style=\"margin:0 0 8px 0;\">" + html.EscapeString(title) + "</h2>\n")
+	builder.WriteString(fmt.Sprintf("<p style=\"margin:0 0 16px 0;color:#666;\">%d rows &middot; generated %s</p>\n", data.rowCount(), html.EscapeString(time.Now().Format(newFormatOptions(config).DatetimeFormat))))
+	builder.WriteString(htmlQueryMarker + "\n")
+	builder.WriteString(table)
+	builder.WriteString("\n</body></html>")
+	return builder.String(), contentType, nil, nil
+}
+
+// attachmentBase renders attachment_name (default "result") for a format.
+// The extension always follows the format (a format extension given in the
+// template is dropped), and the name is reduced to safe
+// characters since it ends up in a quoted MIME parameter.
+func attachmentBase(config Config, data QueryResult, format string) (string, error) {
+	if strings.TrimSpace(config.AttachmentName) == "" {
+		return "result", nil
+	}
+	tmpl, err := template.New("attachment_name").Parse(config.AttachmentName)
+	if err != nil {
+		return "", fmt.Errorf("attachment_name parse failed: %w", err)
+	}
+	var builder strings.Builder
+	if err := tmpl.Execute(&builder, subjectData{RowCount: data.rowCount(), Query: config.SQL, Now: time.Now(), Format: format}); err != nil {
+		return "", fmt.Errorf("attachment_name render failed: %w", err)
+	}
+	name := strings.TrimSpace(builder.String())
+	if ext := filepath.Ext(name); ext != "" {
+		if _, known := renderers[strings.ToLower(ext[1:])]; known {
+			name = strings.TrimSuffix(name, ext)
+		}
+	}
+	name = safeFilenamePart(name)
+	if strings.Trim(name, "._") == "" {
+		return "", errors.New("attachment_name rendered an empty file name")
+	}
+	return name, nil
+}
+
+// fillNulls writes null_string into NULL cells for the text-based formats;
+// json keeps real nulls and xlsx leaves the cell empty.
+func fillNulls(config Config, format string, data QueryResult) QueryResult {
+	if config.NullString == "" || format == "json" || format == "xlsx" {
+		return data
+	}
+	filled := data
+	filled.Rows = make([][]string, len(data.Rows))
+	for r, row := range data.Rows {
+		filled.Rows[r] = append([]string{}, row...)
+		if r >= len(data.Nulls) {
+			continue
+		}
+		for i, null := range data.Nulls[r] {
+			if null && i < len(row) {
+				filled.Rows[r][i] = config.NullString
+			}
+		}
+	}
+	filled.ResultSets = make([]QueryResult, len(data.ResultSets))
+	for i, set := range data.ResultSets {
+		filled.ResultSets[i] = fillNulls(config, format, set)
+	}
+	return filled
+}
+
+func renderCSVOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	if strings.TrimSpace(config.SplitAttachmentBy) != "" {
+		attachments, err := renderSplitCSV(config, data)
+		if err != nil {
+			return "", "", nil, err
+		}
+		body := fmt.Sprintf("CSV result attached as %d files split by %s.", len(attachments), config.SplitAttachmentBy)
+		return body, textPlain, attachments, nil
+	}
+	result := data.StreamedCSV
+	if result == "" {
+		var err error
+		if result, err = renderCSV(config, data); err != nil {
+			return "", "", nil, err
+		}
+	}
+	base, err := attachmentBase(config, data, "csv")
+	if err != nil {
+		return "", "", nil, err
+	}
+	return "CSV result attached as " + base + ".csv.", textPlain, []*Attachment{{
+		Filename:    base + ".csv",
+		ContentType: "text/csv; charset=\"utf-8\"",
+		Data:        []byte(result),
+	}}, nil
+}
+
+func renderJSONOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	render := renderJSON
+	if config.JSONSchema {
+		render = renderJSONSchema
+	}
+	result, err := render(data)
+	if err != nil {
+		return "", "", nil, err
+	}
+	base, err := attachmentBase(config, data, "json")
+	if err != nil {
+		return "", "", nil, err
+	}
+	return "JSON result attached as " + base + ".json.", textPlain, []*Attachment{{
+		Filename:    base + ".json",
+		ContentType: "application/json",
+		Data:        result,
+	}}, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// runScheduled keeps the process alive and calls cycle on every tick of the
+// standard five-field cron spec. A failed tick is logged and the next one
+// still runs, and so does one after a tick that panicked; a tick is skipped
+// (and logged) while the previous one is still going.
+// SIGINT or SIGTERM stops the schedule after the running tick finishes.
+func runScheduled(spec string, cycle func() error, debug bool) error {
+	schedule, err := cron.ParseStandard(strings.TrimSpace(spec))
+	if err != nil {
+		return err
+	}
+	cronLogger := cronLog{debug: debug}
+	scheduler := cron.New(cron.WithLogger(cronLogger), cron.WithChain(cron.Recover(cronLogger), cron.SkipIfStillRunning(cronLogger)))
+	scheduler.Schedule(schedule, cron.FuncJob(func() {
+		debugf(debug, "schedule: tick")
+		if err := cycle(); err != nil {
+			logger.printf("schedule: run failed: %v", err)
+		}
+	}))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	scheduler.Start()
+	debugf(debug, "schedule: %s, first run at %s", spec, scheduler.Entries()[0].Next.Format(time.RFC3339))
+
+	received := <-signals
+	logger.printf("schedule: received %s, stopping", received)
+	<-scheduler.Stop().Done()
+	return nil
+}
+
+// cronLog writes the scheduler's messages through logger: skipped ticks and
+// recovered panics always, its routine bookkeeping only with -debug.
+type cronLog struct {
+	debug bool
+}
+
+func (l cronLog) Info(msg string, keysAndValues ...interface{}) {
+	if msg == "skip" {
+		logger.printf("schedule: tick skipped, the previous run is still going")
+		return
+	}
+	debugf(l.debug, "schedule: %s%s", msg, cronFields(keysAndValues))
+}
+
+func (l cronLog) Error(err error, msg string, keysAndValues ...interface{}) {
+	logger.errorf("schedule: %s: %v%s", msg, err, cronFields(keysAndValues))
+}
+
+func cronFields(keysAndValues []interface{}) string {
+	var fields strings.Builder
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fmt.Fprintf(&fields, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	return fields.String()
+}
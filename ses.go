@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// sendSES hands the MIME message to the SES v2 API instead of an SMTP
+// server. Region and credentials come from the default AWS chain
+// (environment, shared config, instance or task role).
+func sendSES(config SMTPConfig, recipients []string, message []byte, debug bool) error {
+	ctx := context.Background()
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Second)
+		defer cancel()
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("ses config failed: %w", err)
+	}
+	if awsConfig.Region == "" {
+		return errors.New("ses config failed: no AWS region set (AWS_REGION or shared config)")
+	}
+	debugf(debug, "ses: region=%s recipients=%d", awsConfig.Region, len(recipients))
+	output, err := sesv2.NewFromConfig(awsConfig).SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(config.From),
+		Destination:      &types.Destination{ToAddresses: recipients},
+		Content:          &types.EmailContent{Raw: &types.RawMessage{Data: message}},
+	})
+	if err != nil {
+		return fmt.Errorf("ses send failed: %w", err)
+	}
+	debugf(debug, "ses: message id=%s", aws.ToString(output.MessageId))
+	return nil
+}
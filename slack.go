@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// Slack rejects very long messages; keep well under its 40k character cap
+// so the code block fence is never cut off.
+const slackTextLimit = 3500
+
+func sendSlack(config Config, data QueryResult, debug bool) error {
+	data = fillNulls(config, "slack", data)
+	title := messageSubject(config.SMTP)
+	if strings.TrimSpace(title) == "" {
+		title = "notifysql report"
+	}
+	text := fmt.Sprintf("*%s* (%d rows)", title, data.rowCount())
+	if len(data.Rows) > 0 {
+		text += "\n```\n" + slackTable(data, slackTextLimit-len(text)-8) + "\n```"
+	} else {
+		text += "\nNo rows returned."
+	}
+	payload := map[string]interface{}{"text": text}
+	if channel := strings.TrimSpace(config.Slack.Channel); channel != "" {
+		payload["channel"] = channel
+	}
+	debugf(debug, "slack: post (%d rows)", len(data.Rows))
+	if err := postJSON(config.Slack.WebhookURL, payload, nil); err != nil {
+		return fmt.Errorf("slack %w", err)
+	}
+	return nil
+}
+
+// slackTable aligns columns for a monospace code block and stops adding rows
+// once limit characters are reached.
+func slackTable(data QueryResult, limit int) string {
+	var builder strings.Builder
+	writer := tabwriter.NewWriter(&builder, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, strings.Join(sanitizeRow(data.Columns), "\t"))
+	for _, row := range data.Rows {
+		_, _ = fmt.Fprintln(writer, strings.Join(sanitizeRow(row), "\t"))
+	}
+	_ = writer.Flush()
+	lines := strings.Split(strings.TrimRight(builder.String(), "\n"), "\n")
+
+	size := 0
+	for i, line := range lines {
+		if size+len(line)+1 > limit && i > 0 {
+			more := fmt.Sprintf("… %d more rows", len(lines)-i)
+			return strings.Join(lines[:i], "\n") + "\n" + more
+		}
+		size += len(line) + 1
+	}
+	return strings.Join(lines, "\n")
+}
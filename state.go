@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// jobState is what state_file remembers per job: the hash of the last
+// result and when that result was last mailed, and the watermark_column
+// value the next run starts from.
+type jobState struct {
+	Hash      string     `json:"hash,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	Watermark string     `json:"watermark,omitempty"`
+}
+
+// Concurrent jobs share one state file, so updates are serialized.
+var stateMu sync.Mutex
+
+// resultHash covers the columns and rows of every result set, not the
+// timing or warnings.
+func resultHash(data QueryResult) string {
+	sets := [][][]string{append([][]string{data.Columns}, data.Rows...)}
+	for _, set := range data.ResultSets {
+		sets = append(sets, append([][]string{set.Columns}, set.Rows...))
+	}
+	encoded, _ := json.Marshal(sets)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// suppresses reports whether a result with hash was already mailed and
+// resend_after (if set) has not passed since.
+func (state jobState) suppresses(hash string, resendAfter time.Duration, now time.Time) bool {
+	if state.Hash != hash || state.SentAt == nil {
+		return false
+	}
+	return resendAfter <= 0 || now.Sub(*state.SentAt) < resendAfter
+}
+
+// unsent updates the state after a run that mailed nothing: the send time
+// only survives while the result stays the same, so a condition that clears
+// and comes back is alerted again.
+func (state *jobState) unsent(hash string) {
+	if state.Hash != hash {
+		state.Hash = hash
+		state.SentAt = nil
+	}
+}
+
+func readStateFile(path string) (map[string]jobState, error) {
+	states := map[string]jobState{}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("state_file read failed: %w", err)
+	}
+	if err := json.Unmarshal(content, &states); err != nil {
+		return nil, fmt.Errorf("state_file %s is not valid: %w", path, err)
+	}
+	return states, nil
+}
+
+func loadJobState(path string, job string) (jobState, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	states, err := readStateFile(path)
+	if err != nil {
+		return jobState{}, err
+	}
+	return states[job], nil
+}
+
+// updateJobState applies update to the job's stored state and rewrites the
+// file through a temporary file and rename, so a crash never leaves it half
+// written.
+func updateJobState(path string, job string, update func(state *jobState)) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	states, err := readStateFile(path)
+	if err != nil {
+		return err
+	}
+	state := states[job]
+	update(&state)
+	states[job] = state
+	content, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("state_file write failed: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(append(content, '\n')); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("state_file write failed: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("state_file write failed: %w", err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("state_file write failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+func sendWebhook(config WebhookConfig, query string, data QueryResult, debug bool) error {
+	rows := make([][]interface{}, len(data.Rows))
+	for i, row := range data.Rows {
+		rows[i] = make([]interface{}, len(row))
+		for j, cell := range row {
+			if i < len(data.Nulls) && data.Nulls[i][j] {
+				continue
+			}
+			rows[i][j] = cell
+		}
+	}
+	columns := data.Columns
+	if columns == nil {
+		columns = []string{}
+	}
+	payload := map[string]interface{}{
+		"query":     query,
+		"columns":   columns,
+		"rows":      rows,
+		"row_count": data.rowCount(),
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("json encode failed: %w", err)
+	}
+	headers := map[string]string{}
+	for key, value := range config.Headers {
+		headers[key] = value
+	}
+	if config.Secret != "" {
+		header := config.SignatureHeader
+		if strings.TrimSpace(header) == "" {
+			header = "X-Signature"
+		}
+		headers[header] = signPayload(config.Secret, body)
+	}
+	method := strings.ToUpper(strings.TrimSpace(config.Method))
+	if method == "" {
+		method = http.MethodPost
+	}
+	debugf(debug, "webhook: %s %s (%d bytes)", method, config.URL, len(body))
+	if err := sendBody(method, config.URL, body, headers); err != nil {
+		return fmt.Errorf("webhook %w", err)
+	}
+	return nil
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postJSON(url string, payload interface{}, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("json encode failed: %w", err)
+	}
+	return postBody(url, body, headers)
+}
+
+func postBody(url string, body []byte, headers map[string]string) error {
+	return sendBody(http.MethodPost, url, body, headers)
+}
+
+func sendBody(method string, url string, body []byte, headers map[string]string) error {
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http request failed: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("http %s failed: %w", strings.ToLower(method), err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("http %s failed: %s %s", strings.ToLower(method), response.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+func init() {
+	registerRenderer("xlsx", RendererFunc(renderXLSXOutput))
+}
+
+func renderXLSXOutput(config Config, data QueryResult) (string, string, []*Attachment, error) {
+	result, err := renderXLSX(data)
+	if err != nil {
+		return "", "", nil, err
+	}
+	base, err := attachmentBase(config, data, "xlsx")
+	if err != nil {
+		return "", "", nil, err
+	}
+	return "Excel result attached as " + base + ".xlsx.", textPlain, []*Attachment{{
+		Filename:    base + ".xlsx",
+		ContentType: xlsxContentType,
+		Data:        result,
+	}}, nil
+}
+
+// renderXLSX streams rows into the sheet so big results don't keep a cell
+// object per value in memory.
+func renderXLSX(data QueryResult) ([]byte, error) {
+	file := excelize.NewFile()
+	defer file.Close()
+	sheet := file.GetSheetName(0)
+	stream, err := file.NewStreamWriter(sheet)
+	if err != nil {
+		return nil, fmt.Errorf("xlsx stream failed: %w", err)
+	}
+	bold, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return nil, fmt.Errorf("xlsx style failed: %w", err)
+	}
+	header := make([]interface{}, len(data.Columns))
+	for i, column := range data.Columns {
+		header[i] = excelize.Cell{StyleID: bold, Value: column}
+	}
+	if err := stream.SetRow("A1", header); err != nil {
+		return nil, fmt.Errorf("xlsx write failed: %w", err)
+	}
+	for i, row := range data.Rows {
+		cells := make([]interface{}, len(row))
+		for j, value := range row {
+			if i < len(data.Nulls) && data.Nulls[i][j] {
+				continue
+			}
+			cells[j] = xlsxValue(value)
+		}
+		cell, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return nil, err
+		}
+		if err := stream.SetRow(cell, cells); err != nil {
+			return nil, fmt.Errorf("xlsx write failed: %w", err)
+		}
+	}
+	if err := stream.Flush(); err != nil {
+		return nil, fmt.Errorf("xlsx flush failed: %w", err)
+	}
+	var buffer bytes.Buffer
+	if err := file.Write(&buffer); err != nil {
+		return nil, fmt.Errorf("xlsx write failed: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// xlsxValue stores canonical numbers as numbers so they can be summed;
+// anything else, including values like "007", stays text.
+func xlsxValue(value string) interface{} {
+	if parsed, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(parsed, 10) == value {
+		return parsed
+	}
+	if parsed, err := strconv.ParseFloat(value, 64); err == nil && strconv.FormatFloat(parsed, 'f', -1, 64) == value {
+		return parsed
+	}
+	return value
+}